@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"discord-image-uploader/internal/config"
+	"discord-image-uploader/internal/control"
+	"discord-image-uploader/internal/destination"
 	"discord-image-uploader/internal/discord"
 	"discord-image-uploader/internal/history"
+	"discord-image-uploader/internal/state"
 	"discord-image-uploader/internal/uploader"
 	"discord-image-uploader/internal/watcher"
 )
@@ -42,22 +48,59 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	var discordClient *discord.Client
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	if cfg.Discord.WebhookURL != "" {
-		discordClient, err = discord.NewWebhookClient(cfg.Discord.WebhookURL)
-	} else {
-		discordClient, err = discord.NewClient(cfg.Discord.Token, cfg.Discord.ChannelID)
+	timeouts := discord.Timeouts{
+		Connect: time.Duration(cfg.Discord.Timeouts.ConnectSeconds) * time.Second,
+		Read:    time.Duration(cfg.Discord.Timeouts.ReadSeconds) * time.Second,
 	}
 
-	if err != nil {
-		log.Fatalf("Failed to create Discord client: %v", err)
+	proxy := discord.ProxyOptions{
+		URL:      cfg.Discord.Proxy.URL,
+		Username: cfg.Discord.Proxy.Username,
+		Password: cfg.Discord.Proxy.Password,
+	}
+	if proxyURL, err := url.Parse(proxy.URL); err == nil && proxy.URL != "" {
+		log.Printf("Connecting to Discord through proxy %s", proxyURL.Redacted())
 	}
-	defer discordClient.Close()
 
-	err = discordClient.TestConnection(cfg.Discord.TestMessage, cfg.Discord.SendTestMessage)
-	if err != nil {
-		log.Fatalf("Failed to connect to Discord: %v", err)
+	var destinations []destination.Destination
+	for _, destCfg := range cfg.Discord.Destinations {
+		dest, err := newDestination(cfg.Discord, destCfg, cfg.Upload.MaxFileSizeMB, timeouts, proxy)
+		if err != nil {
+			log.Fatalf("Failed to create Discord client for %s: %v", destCfg.Name, err)
+		}
+		defer dest.Close()
+
+		err = dest.Test(ctx)
+		if err != nil {
+			log.Fatalf("Failed to connect to Discord destination %s: %v", destCfg.Name, err)
+		}
+
+		destinations = append(destinations, dest)
+	}
+
+	reviewers := make(map[string]destination.Reviewer)
+	for _, destCfg := range cfg.Discord.Destinations {
+		if !destCfg.Approval.Enabled() {
+			continue
+		}
+
+		reviewer, err := discord.NewReviewClient(ctx, destCfg.Approval.Token, destCfg.Approval.ReviewChannelID, discord.ReviewOptions{
+			Name:           destCfg.Name,
+			APIBaseURL:     cfg.Discord.APIBaseURL,
+			AllowedUserIDs: destCfg.Approval.AllowedUserIDs,
+			AllowedRoleIDs: destCfg.Approval.AllowedRoleIDs,
+			Timeouts:       timeouts,
+			Proxy:          proxy,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up review channel for %s: %v", destCfg.Name, err)
+		}
+		defer reviewer.Close()
+
+		reviewers[destCfg.Name] = reviewer
 	}
 
 	uploadHistory, err := history.New(cfg.History.FilePath)
@@ -65,17 +108,33 @@ func main() {
 		log.Fatalf("Failed to create upload history: %v", err)
 	}
 
-	fileWatcher, err := watcher.New(
-		cfg.Watcher.FolderPath,
-		cfg.Watcher.SupportedFormats,
-		cfg.Watcher.DeleteAfterUpload,
-	)
+	stateStore, err := state.New(cfg.State.FilePath)
+	if err != nil {
+		log.Fatalf("Failed to load state: %v", err)
+	}
+
+	var roots []watcher.Root
+	for _, folder := range cfg.Watcher.Folders {
+		roots = append(roots, watcher.Root{
+			Path:              folder.Path,
+			SupportedFormats:  folder.SupportedFormats,
+			MaxDepth:          *folder.MaxDepth,
+			DeleteAfterUpload: *folder.DeleteAfterUpload,
+			Filter:            newFilter(*folder.Filters),
+		})
+	}
+
+	fileWatcher, err := watcher.New(roots, watcher.Options{
+		ReportRemovals: cfg.Sync.Enabled,
+		Mode:           watcher.Mode(cfg.Watcher.Mode),
+		PollInterval:   time.Duration(cfg.Watcher.PollIntervalSeconds) * time.Second,
+	})
 	if err != nil {
 		log.Fatalf("Failed to create file watcher: %v", err)
 	}
 	defer fileWatcher.Stop()
 
-	imageUploader := uploader.New(cfg, discordClient, fileWatcher, uploadHistory)
+	imageUploader := uploader.New(cfg, destinations, reviewers, fileWatcher, uploadHistory, stateStore)
 
 	fileWatcher.Start()
 
@@ -85,12 +144,85 @@ func main() {
 	}
 	defer imageUploader.Stop()
 
-	log.Println("Discord Image Uploader is running. Press Ctrl+C to stop.")
+	if cfg.Discord.Commands.Enabled {
+		enableCommands(ctx, cfg.Discord.Commands, destinations, imageUploader)
+	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	log.Println("Discord Image Uploader is running. Press Ctrl+C to stop.")
 
-	<-sigChan
+	<-ctx.Done()
+	// A second Ctrl+C ends the process right away.
+	stop()
 
 	log.Println("Shutting down gracefully...")
 }
+
+func newDestination(cfg config.DiscordConfig, destCfg config.DestinationConfig, maxFileSizeMB int, timeouts discord.Timeouts, proxy discord.ProxyOptions) (destination.Destination, error) {
+	color, _ := cfg.Embed.ColorValue()
+
+	opts := discord.Options{
+		Name:            destCfg.Name,
+		APIBaseURL:      cfg.APIBaseURL,
+		TestMessage:     cfg.TestMessage,
+		SendTestMessage: cfg.SendTestMessage,
+		MaxFileBytes:    int64(maxFileSizeMB) * 1024 * 1024,
+		Embed: discord.EmbedOptions{
+			Enabled: cfg.Embed.Enabled,
+			Color:   color,
+		},
+		Thread: discord.ThreadOptions{
+			Forum:              destCfg.Thread.Forum,
+			AppliedTags:        destCfg.Thread.AppliedTags,
+			AutoArchiveMinutes: destCfg.Thread.AutoArchiveMinutes,
+		},
+		Timeouts: timeouts,
+		Proxy:    proxy,
+	}
+
+	if destCfg.WebhookURL != "" {
+		client, err := discord.NewWebhookClient(destCfg.WebhookURL, opts)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
+	client, err := discord.NewBotClient(destCfg.Token, destCfg.ChannelID, opts)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func newFilter(cfg config.FilterConfig) watcher.Filter {
+	return watcher.Filter{
+		Include:       cfg.Include,
+		Exclude:       cfg.Exclude,
+		IncludeRegex:  cfg.IncludeRegex,
+		ExcludeRegex:  cfg.ExcludeRegex,
+		ExcludeHidden: cfg.ExcludeHidden,
+		MinSize:       int64(cfg.MinSizeMB * 1024 * 1024),
+		MaxSize:       int64(cfg.MaxSizeMB * 1024 * 1024),
+		MinAge:        time.Duration(cfg.MinAgeSeconds) * time.Second,
+		MaxAge:        time.Duration(cfg.MaxAgeDays * 24 * float64(time.Hour)),
+	}
+}
+
+func enableCommands(ctx context.Context, cfg config.CommandsConfig, destinations []destination.Destination, controller control.Controller) {
+	opts := discord.CommandOptions{
+		AllowedRoleIDs: cfg.AllowedRoleIDs,
+		AllowedUserIDs: cfg.AllowedUserIDs,
+	}
+
+	for _, dest := range destinations {
+		bot, ok := dest.(*discord.BotClient)
+		if !ok {
+			continue
+		}
+
+		err := bot.EnableCommands(ctx, controller, opts)
+		if err != nil {
+			log.Fatalf("Failed to enable commands for %s: %v", dest.Name(), err)
+		}
+	}
+}
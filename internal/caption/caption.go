@@ -0,0 +1,137 @@
+package caption
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Discord rejects message content longer than this.
+const maxContentLength = 2000
+
+type Data struct {
+	FileName    string
+	RelPath     string
+	Folder      string
+	Size        int64
+	ModTime     time.Time
+	Hostname    string
+	Index       int
+	Count       int
+	UploadTime  time.Time
+	Destination string
+}
+
+type Template struct {
+	tmpl *template.Template
+}
+
+var funcs = template.FuncMap{
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"env":      os.Getenv,
+	"humanize": HumanizeBytes,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+}
+
+// New parses text as a caption template. An empty text yields a template
+// that renders nothing.
+func New(text string) (*Template, error) {
+	if text == "" {
+		return &Template{}, nil
+	}
+
+	tmpl, err := template.New("caption").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message template: %w", err)
+	}
+
+	return &Template{tmpl: tmpl}, nil
+}
+
+// Validate parses text and renders it with sample data, so unknown fields
+// and wrong function arguments are reported at startup rather than on the
+// first upload.
+func Validate(text string) error {
+	t, err := New(text)
+	if err != nil || t.tmpl == nil {
+		return err
+	}
+
+	sample := Data{
+		FileName:    "example.png",
+		RelPath:     "example.png",
+		Folder:      "images",
+		Size:        1024,
+		ModTime:     time.Now(),
+		Hostname:    Hostname(),
+		Index:       1,
+		Count:       1,
+		UploadTime:  time.Now(),
+		Destination: "default",
+	}
+	if err := t.tmpl.Execute(io.Discard, sample); err != nil {
+		return fmt.Errorf("invalid message template: %w", err)
+	}
+
+	return nil
+}
+
+func (t *Template) Render(data Data) (string, error) {
+	if t == nil || t.tmpl == nil {
+		return "", nil
+	}
+
+	var out bytes.Buffer
+	if err := t.tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("failed to render message template: %w", err)
+	}
+
+	return out.String(), nil
+}
+
+// Join combines the captions of a batch into one message content.
+func Join(lines []string) string {
+	var nonEmpty []string
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			nonEmpty = append(nonEmpty, line)
+		}
+	}
+
+	content := strings.Join(nonEmpty, "\n")
+	if runes := []rune(content); len(runes) > maxContentLength {
+		content = string(runes[:maxContentLength-1]) + "…"
+	}
+
+	return content
+}
+
+func Hostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+func HumanizeBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,38 @@
+package caption
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		text  string
+		valid bool
+	}{
+		{"", true},
+		{"{{.FileName}} ({{humanize .Size}}, {{date \"02.01.2006\" .ModTime}})", true},
+		{"{{upper .Destination}} von {{env \"USER\"}}", true},
+		{"{{.Flie}}", false},
+		{"{{humanize .FileName}}", false},
+		{"{{.FileName", false},
+	}
+
+	for _, test := range tests {
+		err := Validate(test.text)
+		if (err == nil) != test.valid {
+			t.Errorf("Validate(%q) = %v, want valid %v", test.text, err, test.valid)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	t.Setenv("CAPTION_TEST", "kamera")
+
+	tmpl, err := New(`{{env "CAPTION_TEST"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := tmpl.Render(Data{})
+	if err != nil || content != "kamera" {
+		t.Errorf("Render = %q, %v, want %q", content, err, "kamera")
+	}
+}
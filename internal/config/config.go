@@ -2,8 +2,15 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
+	"discord-image-uploader/internal/caption"
+
 	"github.com/spf13/viper"
 )
 
@@ -12,20 +19,131 @@ type Config struct {
 	Watcher WatcherConfig `mapstructure:"watcher"`
 	Upload  UploadConfig  `mapstructure:"upload"`
 	History HistoryConfig `mapstructure:"history"`
+	Routing RoutingConfig `mapstructure:"routing"`
+	State   StateConfig   `mapstructure:"state"`
+	Sync    SyncConfig    `mapstructure:"sync"`
 }
 
+const DefaultDestinationName = "default"
+
 type DiscordConfig struct {
-	WebhookURL      string `mapstructure:"webhook_url"`
-	Token           string `mapstructure:"token"`
-	ChannelID       string `mapstructure:"channel_id"`
-	TestMessage     string `mapstructure:"test_message"`
-	SendTestMessage bool   `mapstructure:"send_test_message"`
+	WebhookURL      string              `mapstructure:"webhook_url"`
+	Token           string              `mapstructure:"token"`
+	ChannelID       string              `mapstructure:"channel_id"`
+	TestMessage     string              `mapstructure:"test_message"`
+	SendTestMessage bool                `mapstructure:"send_test_message"`
+	APIBaseURL      string              `mapstructure:"api_base_url"`
+	Destinations    []DestinationConfig `mapstructure:"destinations"`
+	Embed           EmbedConfig         `mapstructure:"embed"`
+	MessageTemplate string              `mapstructure:"message_template"`
+	Thread          ThreadConfig        `mapstructure:"thread"`
+	Commands        CommandsConfig      `mapstructure:"commands"`
+	Approval        ApprovalConfig      `mapstructure:"approval"`
+	Timeouts        TimeoutsConfig      `mapstructure:"timeouts"`
+	Proxy           ProxyConfig         `mapstructure:"proxy"`
+}
+
+// ProxyConfig sends all Discord traffic through an HTTP CONNECT or SOCKS5
+// proxy, e.g. http://proxy:3128 or socks5://proxy:1080.
+type ProxyConfig struct {
+	URL      string `mapstructure:"url"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// TimeoutsConfig bounds single requests to Discord. ReadSeconds is how
+// long Discord may take to answer and how long an upload may stall.
+type TimeoutsConfig struct {
+	ConnectSeconds int `mapstructure:"connect_seconds"`
+	ReadSeconds    int `mapstructure:"read_seconds"`
+}
+
+// ApprovalConfig holds files for review in a private channel before they
+// are published to the destination. The review bot uses Token, which
+// defaults to the destination's or the global bot token.
+type ApprovalConfig struct {
+	ReviewChannelID string   `mapstructure:"review_channel_id"`
+	Token           string   `mapstructure:"token"`
+	AllowedUserIDs  []string `mapstructure:"allowed_user_ids"`
+	AllowedRoleIDs  []string `mapstructure:"allowed_role_ids"`
+}
+
+func (a ApprovalConfig) Enabled() bool {
+	return a.ReviewChannelID != ""
 }
 
+// CommandsConfig enables the /uploader slash commands in bot mode. Only
+// the listed roles and users may use them.
+type CommandsConfig struct {
+	Enabled        bool     `mapstructure:"enabled"`
+	AllowedRoleIDs []string `mapstructure:"allowed_role_ids"`
+	AllowedUserIDs []string `mapstructure:"allowed_user_ids"`
+}
+
+type ThreadConfig struct {
+	ID                 string   `mapstructure:"id"`
+	Strategy           string   `mapstructure:"strategy"`
+	NamePrefix         string   `mapstructure:"name_prefix"`
+	Forum              bool     `mapstructure:"forum"`
+	AppliedTags        []string `mapstructure:"applied_tags"`
+	AutoArchiveMinutes int      `mapstructure:"auto_archive_minutes"`
+}
+
+type EmbedConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Color   string `mapstructure:"color"`
+}
+
+type DestinationConfig struct {
+	Name       string         `mapstructure:"name"`
+	WebhookURL string         `mapstructure:"webhook_url"`
+	Token      string         `mapstructure:"token"`
+	ChannelID  string         `mapstructure:"channel_id"`
+	Thread     ThreadConfig   `mapstructure:"thread"`
+	Approval   ApprovalConfig `mapstructure:"approval"`
+}
+
+// WatcherConfig describes the watched folders. Subfolders are watched too;
+// MaxDepth limits how deep, with 1 meaning only the folder itself and 0 no
+// limit. The settings apply to FolderPath and are the defaults for Folders.
+// Mode is fsnotify, poll or auto; see watcher.Mode.
 type WatcherConfig struct {
-	FolderPath        string   `mapstructure:"folder_path"`
-	SupportedFormats  []string `mapstructure:"supported_formats"`
-	DeleteAfterUpload bool     `mapstructure:"delete_after_upload"`
+	Mode                string         `mapstructure:"mode"`
+	PollIntervalSeconds int            `mapstructure:"poll_interval_seconds"`
+	FolderPath          string         `mapstructure:"folder_path"`
+	SupportedFormats    []string       `mapstructure:"supported_formats"`
+	DeleteAfterUpload   bool           `mapstructure:"delete_after_upload"`
+	MaxDepth            int            `mapstructure:"max_depth"`
+	Filters             FilterConfig   `mapstructure:"filters"`
+	Folders             []FolderConfig `mapstructure:"folders"`
+}
+
+// FilterConfig narrows down the watched files. Globs and regular
+// expressions match the path relative to the watched folder, with forward
+// slashes; a glob without a slash matches the file name.
+type FilterConfig struct {
+	Include       []string `mapstructure:"include"`
+	Exclude       []string `mapstructure:"exclude"`
+	IncludeRegex  []string `mapstructure:"include_regex"`
+	ExcludeRegex  []string `mapstructure:"exclude_regex"`
+	ExcludeHidden bool     `mapstructure:"exclude_hidden"`
+	MinSizeMB     float64  `mapstructure:"min_size_mb"`
+	MaxSizeMB     float64  `mapstructure:"max_size_mb"`
+	MinAgeSeconds int      `mapstructure:"min_age_seconds"`
+	MaxAgeDays    float64  `mapstructure:"max_age_days"`
+}
+
+// FolderConfig is one watched folder. Fields left out fall back to the
+// watcher-wide settings; Destinations and MessageTemplate apply to files
+// no routing rule matched.
+type FolderConfig struct {
+	Path              string        `mapstructure:"path"`
+	SupportedFormats  []string      `mapstructure:"supported_formats"`
+	DeleteAfterUpload *bool         `mapstructure:"delete_after_upload"`
+	MaxDepth          *int          `mapstructure:"max_depth"`
+	Filters           *FilterConfig `mapstructure:"filters"`
+	Destinations      []string      `mapstructure:"destinations"`
+	MessageTemplate   string        `mapstructure:"message_template"`
 }
 
 type UploadConfig struct {
@@ -34,6 +152,32 @@ type UploadConfig struct {
 	MaxFileSizeMB   int `mapstructure:"max_file_size_mb"`
 }
 
+type RoutingConfig struct {
+	DefaultDestinations []string     `mapstructure:"default_destinations"`
+	Rules               []RuleConfig `mapstructure:"rules"`
+}
+
+type RuleConfig struct {
+	Name            string   `mapstructure:"name"`
+	Folder          string   `mapstructure:"folder"`
+	Pattern         string   `mapstructure:"pattern"`
+	Extensions      []string `mapstructure:"extensions"`
+	MinSizeMB       float64  `mapstructure:"min_size_mb"`
+	MaxSizeMB       float64  `mapstructure:"max_size_mb"`
+	Destinations    []string `mapstructure:"destinations"`
+	MessageTemplate string   `mapstructure:"message_template"`
+}
+
+// SyncConfig enables mirror-sync: deleting or editing an uploaded file
+// locally deletes or updates the Discord message it was posted in.
+type SyncConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+type StateConfig struct {
+	FilePath string `mapstructure:"file_path"`
+}
+
 type HistoryConfig struct {
 	FilePath            string `mapstructure:"file_path"`
 	CleanupMissingFiles bool   `mapstructure:"cleanup_missing_files"`
@@ -64,20 +208,36 @@ func Load(configPath string) (*Config, error) {
 }
 
 func validateConfig(config *Config) error {
-	if config.Discord.WebhookURL == "" && config.Discord.Token == "" {
-		return fmt.Errorf("either discord webhook URL or bot token is required")
+	if err := validateDestinations(&config.Discord); err != nil {
+		return err
 	}
 
-	if config.Discord.Token != "" && config.Discord.ChannelID == "" {
-		return fmt.Errorf("discord channel ID is required when using bot token")
+	if err := validateRouting(config); err != nil {
+		return err
 	}
 
-	if config.Watcher.FolderPath == "" {
-		return fmt.Errorf("watcher folder path is required")
+	if err := validateCommands(&config.Discord); err != nil {
+		return err
 	}
 
-	if len(config.Watcher.SupportedFormats) == 0 {
-		config.Watcher.SupportedFormats = []string{".png", ".jpg", ".jpeg", ".gif", ".webp"}
+	if err := validateProxy(config.Discord.Proxy); err != nil {
+		return err
+	}
+
+	if config.Discord.Embed.Color == "" {
+		config.Discord.Embed.Color = "#5865F2"
+	}
+
+	if _, err := config.Discord.Embed.ColorValue(); err != nil {
+		return err
+	}
+
+	if err := caption.Validate(config.Discord.MessageTemplate); err != nil {
+		return err
+	}
+
+	if err := validateWatcher(config); err != nil {
+		return err
 	}
 
 	if config.Upload.BatchSize <= 0 {
@@ -88,8 +248,17 @@ func validateConfig(config *Config) error {
 		config.Upload.IntervalSeconds = 10
 	}
 
-	if config.Upload.MaxFileSizeMB <= 0 {
-		config.Upload.MaxFileSizeMB = 8
+	// 0 leaves the limit to the destinations.
+	if config.Upload.MaxFileSizeMB < 0 {
+		config.Upload.MaxFileSizeMB = 0
+	}
+
+	if config.Discord.Timeouts.ConnectSeconds <= 0 {
+		config.Discord.Timeouts.ConnectSeconds = 10
+	}
+
+	if config.Discord.Timeouts.ReadSeconds <= 0 {
+		config.Discord.Timeouts.ReadSeconds = 60
 	}
 
 	if config.Discord.TestMessage == "" {
@@ -100,5 +269,334 @@ func validateConfig(config *Config) error {
 		config.History.FilePath = "data/upload_history.json"
 	}
 
+	if config.State.FilePath == "" {
+		config.State.FilePath = "data/state.json"
+	}
+
+	return nil
+}
+
+// ColorValue returns the embed color as the integer Discord expects.
+func (e EmbedConfig) ColorValue() (int, error) {
+	color, err := strconv.ParseInt(strings.TrimPrefix(e.Color, "#"), 16, 32)
+	if err != nil || color < 0 || color > 0xFFFFFF {
+		return 0, fmt.Errorf("invalid embed color %q, expected hex like #5865F2", e.Color)
+	}
+	return int(color), nil
+}
+
+func validateDestinations(discord *DiscordConfig) error {
+	if len(discord.Destinations) == 0 {
+		if discord.WebhookURL == "" && discord.Token == "" {
+			return fmt.Errorf("either discord webhook URL or bot token is required")
+		}
+
+		if discord.Token != "" && discord.ChannelID == "" {
+			return fmt.Errorf("discord channel ID is required when using bot token")
+		}
+
+		discord.Destinations = []DestinationConfig{{
+			Name:       DefaultDestinationName,
+			WebhookURL: discord.WebhookURL,
+			Token:      discord.Token,
+			ChannelID:  discord.ChannelID,
+			Thread:     discord.Thread,
+			Approval:   discord.Approval,
+		}}
+		if err := validateApproval(discord, &discord.Destinations[0]); err != nil {
+			return err
+		}
+		return validateThread(&discord.Destinations[0])
+	}
+
+	names := make(map[string]bool)
+	for i := range discord.Destinations {
+		dest := &discord.Destinations[i]
+
+		if dest.Name == "" {
+			return fmt.Errorf("discord destination #%d needs a name", i+1)
+		}
+
+		if names[dest.Name] {
+			return fmt.Errorf("discord destination name %q is used more than once", dest.Name)
+		}
+		names[dest.Name] = true
+
+		if dest.WebhookURL == "" && dest.Token == "" {
+			dest.Token = discord.Token
+		}
+
+		if dest.WebhookURL == "" && dest.Token == "" {
+			return fmt.Errorf("discord destination %q needs a webhook URL or bot token", dest.Name)
+		}
+
+		if dest.WebhookURL == "" && dest.ChannelID == "" {
+			return fmt.Errorf("discord destination %q needs a channel ID when using bot token", dest.Name)
+		}
+
+		if err := validateApproval(discord, dest); err != nil {
+			return err
+		}
+
+		if err := validateThread(dest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateApproval(discord *DiscordConfig, dest *DestinationConfig) error {
+	approval := &dest.Approval
+	if !approval.Enabled() {
+		return nil
+	}
+
+	if approval.Token == "" {
+		approval.Token = dest.Token
+	}
+	if approval.Token == "" {
+		approval.Token = discord.Token
+	}
+	if approval.Token == "" {
+		return fmt.Errorf("approval for destination %q needs a bot token", dest.Name)
+	}
+
+	if len(approval.AllowedUserIDs) == 0 && len(approval.AllowedRoleIDs) == 0 {
+		return fmt.Errorf("approval for destination %q needs at least one entry in allowed_user_ids or allowed_role_ids", dest.Name)
+	}
+
+	return nil
+}
+
+func validateCommands(discord *DiscordConfig) error {
+	if !discord.Commands.Enabled {
+		return nil
+	}
+
+	if len(discord.Commands.AllowedRoleIDs) == 0 && len(discord.Commands.AllowedUserIDs) == 0 {
+		return fmt.Errorf("commands need at least one entry in allowed_role_ids or allowed_user_ids")
+	}
+
+	for _, dest := range discord.Destinations {
+		if dest.Token != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("commands are only available in bot mode")
+}
+
+func validateProxy(proxy ProxyConfig) error {
+	if proxy.URL == "" {
+		return nil
+	}
+
+	parsed, err := url.Parse(proxy.URL)
+	if err != nil || parsed.Host == "" {
+		return fmt.Errorf("invalid proxy url %q", proxy.URL)
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "socks5" {
+		return fmt.Errorf("proxy url %q must start with http:// or socks5://", proxy.URL)
+	}
+	return nil
+}
+
+func validateThread(dest *DestinationConfig) error {
+	thread := &dest.Thread
+
+	if thread.Strategy == "" && thread.ID != "" {
+		thread.Strategy = "fixed"
+	}
+
+	switch thread.Strategy {
+	case "", "daily", "folder", "session":
+	case "fixed":
+		if thread.ID == "" {
+			return fmt.Errorf("discord destination %q uses thread strategy fixed without a thread id", dest.Name)
+		}
+	default:
+		return fmt.Errorf("discord destination %q has unknown thread strategy %q", dest.Name, thread.Strategy)
+	}
+
+	creates := thread.Strategy == "daily" || thread.Strategy == "folder" || thread.Strategy == "session"
+	if creates && dest.WebhookURL != "" && !thread.Forum {
+		return fmt.Errorf("discord destination %q: webhooks can only create threads in forum channels", dest.Name)
+	}
+
+	if thread.Forum && thread.Strategy == "" {
+		return fmt.Errorf("discord destination %q posts to a forum and needs a thread strategy", dest.Name)
+	}
+
+	if thread.AutoArchiveMinutes == 0 {
+		thread.AutoArchiveMinutes = 1440
+	}
+
+	return nil
+}
+
+// validateWatcher turns watcher.folder_path into the only entry of
+// watcher.folders and fills in the defaults of every folder, so the rest
+// of the program only deals with folders.
+func validateWatcher(config *Config) error {
+	watcher := &config.Watcher
+
+	if watcher.MaxDepth < 0 {
+		return fmt.Errorf("watcher max_depth can't be negative")
+	}
+
+	switch watcher.Mode {
+	case "":
+		watcher.Mode = "fsnotify"
+	case "fsnotify", "poll", "auto":
+	default:
+		return fmt.Errorf("invalid watcher mode %q, expected fsnotify, poll or auto", watcher.Mode)
+	}
+
+	if watcher.PollIntervalSeconds < 0 {
+		return fmt.Errorf("watcher poll_interval_seconds can't be negative")
+	}
+	if watcher.PollIntervalSeconds == 0 {
+		watcher.PollIntervalSeconds = 5
+	}
+
+	if len(watcher.SupportedFormats) == 0 {
+		watcher.SupportedFormats = []string{".png", ".jpg", ".jpeg", ".gif", ".webp"}
+	}
+
+	if len(watcher.Folders) == 0 {
+		if watcher.FolderPath == "" {
+			return fmt.Errorf("watcher folder path is required")
+		}
+		watcher.Folders = []FolderConfig{{Path: watcher.FolderPath}}
+	} else if watcher.FolderPath != "" {
+		return fmt.Errorf("use either watcher.folder_path or watcher.folders, not both")
+	}
+
+	known := make(map[string]bool)
+	for _, dest := range config.Discord.Destinations {
+		known[dest.Name] = true
+	}
+
+	paths := make(map[string]bool)
+	for i := range watcher.Folders {
+		folder := &watcher.Folders[i]
+
+		if folder.Path == "" {
+			return fmt.Errorf("watcher folder #%d has no path", i+1)
+		}
+		folder.Path = filepath.Clean(folder.Path)
+
+		if paths[folder.Path] {
+			return fmt.Errorf("watcher folder %s is configured twice", folder.Path)
+		}
+		paths[folder.Path] = true
+
+		if len(folder.SupportedFormats) == 0 {
+			folder.SupportedFormats = watcher.SupportedFormats
+		}
+
+		if folder.DeleteAfterUpload == nil {
+			deleteAfterUpload := watcher.DeleteAfterUpload
+			folder.DeleteAfterUpload = &deleteAfterUpload
+		}
+
+		if config.Sync.Enabled && *folder.DeleteAfterUpload {
+			return fmt.Errorf("sync mode can't be combined with delete_after_upload (folder %s)", folder.Path)
+		}
+
+		if folder.MaxDepth == nil {
+			maxDepth := watcher.MaxDepth
+			folder.MaxDepth = &maxDepth
+		}
+
+		if *folder.MaxDepth < 0 {
+			return fmt.Errorf("watcher folder %s: max_depth can't be negative", folder.Path)
+		}
+
+		if folder.Filters == nil {
+			folder.Filters = &watcher.Filters
+		}
+
+		if err := validateFilters(*folder.Filters); err != nil {
+			return fmt.Errorf("watcher folder %s: %w", folder.Path, err)
+		}
+
+		for _, name := range folder.Destinations {
+			if !known[name] {
+				return fmt.Errorf("watcher folder %s uses unknown destination %q", folder.Path, name)
+			}
+		}
+
+		if err := caption.Validate(folder.MessageTemplate); err != nil {
+			return fmt.Errorf("watcher folder %s: %w", folder.Path, err)
+		}
+	}
+
+	return nil
+}
+
+func validateFilters(filters FilterConfig) error {
+	for _, pattern := range append(append([]string{}, filters.Include...), filters.Exclude...) {
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return fmt.Errorf("invalid filter glob %q", pattern)
+		}
+	}
+
+	for _, expr := range append(append([]string{}, filters.IncludeRegex...), filters.ExcludeRegex...) {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("invalid filter regex %q: %w", expr, err)
+		}
+	}
+
+	if filters.MinSizeMB < 0 || filters.MaxSizeMB < 0 || filters.MinAgeSeconds < 0 || filters.MaxAgeDays < 0 {
+		return fmt.Errorf("filter sizes and ages can't be negative")
+	}
+
+	return nil
+}
+
+func validateRouting(config *Config) error {
+	known := make(map[string]bool)
+	for _, dest := range config.Discord.Destinations {
+		known[dest.Name] = true
+	}
+
+	for _, name := range config.Routing.DefaultDestinations {
+		if !known[name] {
+			return fmt.Errorf("routing default destination %q is not configured", name)
+		}
+	}
+
+	for i := range config.Routing.Rules {
+		rule := &config.Routing.Rules[i]
+
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule #%d", i+1)
+		}
+
+		if len(rule.Destinations) == 0 {
+			return fmt.Errorf("routing %s has no destinations", rule.Name)
+		}
+
+		for _, name := range rule.Destinations {
+			if !known[name] {
+				return fmt.Errorf("routing %s uses unknown destination %q", rule.Name, name)
+			}
+		}
+
+		if err := caption.Validate(rule.MessageTemplate); err != nil {
+			return fmt.Errorf("routing %s: %w", rule.Name, err)
+		}
+
+		for j, ext := range rule.Extensions {
+			ext = strings.ToLower(ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			rule.Extensions[j] = ext
+		}
+	}
+
 	return nil
 }
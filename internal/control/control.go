@@ -0,0 +1,31 @@
+package control
+
+import "time"
+
+// Controller is the part of the running uploader that can be operated
+// remotely, e.g. through the bot's slash commands.
+type Controller interface {
+	Status() Status
+	Pause()
+	Resume()
+	// Flush uploads the queue right away instead of waiting for the next
+	// interval. It returns once the queue has been worked through.
+	Flush()
+	// Retry puts failed and rejected files back into the queue, together
+	// with the files of interrupted uploads that couldn't be checked, and
+	// returns how many files were affected.
+	Retry() int
+}
+
+type Status struct {
+	QueueLength int
+	Paused      bool
+	LastUpload  time.Time
+	LastError   string
+	LastErrorAt time.Time
+	FailedFiles int
+	// UnresolvedFiles were being sent when the uploader stopped and may or
+	// may not have been posted.
+	UnresolvedFiles int
+	RateLimited     map[string]time.Time
+}
@@ -0,0 +1,181 @@
+package destination
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+type Capabilities struct {
+	MaxAttachments  int
+	MaxFileBytes    int64
+	MaxBytes        int64
+	CanEditMessages bool
+}
+
+// Destination is a target the uploader can post files to. The webhook and
+// bot modes in internal/discord are the built-in implementations. Requests
+// are aborted when their context is cancelled. If a new thread was created
+// but the message then failed, Upload returns a Result with only the
+// thread's ChannelID and ThreadID set together with the error.
+type Destination interface {
+	Name() string
+	Upload(ctx context.Context, filePath string, message Message) (*Result, error)
+	UploadBatch(ctx context.Context, filePaths []string, message Message) (*Result, error)
+	Test(ctx context.Context) error
+	Close() error
+	Capabilities() Capabilities
+}
+
+// Message carries everything about a post besides the files themselves.
+// ThreadID posts into an existing thread; ThreadName asks the destination
+// to create a new thread (or forum post) for the message. Destinations that
+// support it use Nonce to make sure a retried send isn't posted twice.
+type Message struct {
+	Content    string
+	ThreadID   string
+	ThreadName string
+	Nonce      string
+}
+
+// Editor is implemented by destinations that can change messages after
+// they were posted. Sync mode uses it to mirror local deletions and edits.
+type Editor interface {
+	// RemoveAttachment takes the attachment of filePath off its message and
+	// deletes the message once nothing else is left on it.
+	RemoveAttachment(ctx context.Context, ref MessageRef, filePath string) error
+	// ReplaceAttachment swaps the attachment for the current content of
+	// filePath, keeping the rest of the message.
+	ReplaceAttachment(ctx context.Context, ref MessageRef, filePath string) (*Result, error)
+}
+
+type Decision int
+
+const (
+	DecisionPending Decision = iota
+	DecisionApproved
+	DecisionRejected
+)
+
+// Reviewer posts files to a private channel for a human check before they
+// are published to a destination.
+type Reviewer interface {
+	// Submit posts filePath for review and returns the ID of the review.
+	Submit(ctx context.Context, filePath string, message Message) (string, error)
+	// Decision looks up a decision that may have been made while nobody
+	// was listening, e.g. before a restart.
+	Decision(ctx context.Context, reviewID string) (Decision, error)
+	// OnDecision registers the function called for every decision.
+	OnDecision(handler func(reviewID string, decision Decision))
+	Close() error
+}
+
+// Reconciler is implemented by destinations that can look up whether a
+// message was posted, for uploads interrupted by a crash.
+type Reconciler interface {
+	// FindUpload returns the message posted since the given time that
+	// carries filePaths, or nil if there is none.
+	FindUpload(ctx context.Context, threadID string, filePaths []string, since time.Time) (*Result, error)
+}
+
+// MessageRef points at an attachment of a previously posted message.
+type MessageRef struct {
+	MessageID    string
+	ChannelID    string
+	ThreadID     string
+	AttachmentID string
+}
+
+var (
+	ErrThreadNotFound  = errors.New("thread not found")
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrNotSent marks errors of requests that failed before anything was
+	// written to the connection, so they can't have reached Discord.
+	ErrNotSent = errors.New("request was not sent")
+)
+
+type Attachment struct {
+	ID       string
+	Filename string
+	URL      string
+}
+
+type FileStatus string
+
+const (
+	FileSent    FileStatus = "sent"
+	FileSkipped FileStatus = "skipped"
+	FileFailed  FileStatus = "failed"
+)
+
+type FileResult struct {
+	Path       string
+	Status     FileStatus
+	Reason     string
+	Attachment Attachment
+}
+
+// Result describes the message created by an upload. Files holds one entry
+// per requested file, so callers can tell which files actually got through.
+// If no file could be sent at all, MessageID is empty.
+type Result struct {
+	MessageID   string
+	ChannelID   string
+	WebhookID   string
+	ThreadID    string
+	Attachments []Attachment
+	Files       []FileResult
+}
+
+func (r *Result) File(filePath string) (FileResult, bool) {
+	for _, file := range r.Files {
+		if file.Path == filePath {
+			return file, true
+		}
+	}
+	return FileResult{}, false
+}
+
+// AttachmentFor returns the attachment that was created for filePath. Order
+// of uploaded files is preserved, so index is used when the name was
+// rewritten by the destination (e.g. spaces replaced).
+func (r *Result) AttachmentFor(filePath string, index int) Attachment {
+	fileName := filepath.Base(filePath)
+	for _, attachment := range r.Attachments {
+		if attachment.Filename == fileName {
+			return attachment
+		}
+	}
+
+	if index >= 0 && index < len(r.Attachments) {
+		return r.Attachments[index]
+	}
+
+	return Attachment{}
+}
+
+type RateLimitError struct {
+	Route      string
+	RetryAfter time.Duration
+	RetryAt    time.Time
+	Global     bool
+}
+
+func NewRateLimitError(route string, retryAfter time.Duration, global bool) *RateLimitError {
+	return &RateLimitError{
+		Route:      route,
+		RetryAfter: retryAfter,
+		RetryAt:    time.Now().Add(retryAfter),
+		Global:     global,
+	}
+}
+
+func (e *RateLimitError) Error() string {
+	scope := e.Route
+	if e.Global {
+		scope = "global"
+	}
+	return fmt.Sprintf("rate limited on %s, retry after %s", scope, e.RetryAfter.Round(time.Millisecond))
+}
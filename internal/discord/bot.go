@@ -0,0 +1,418 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"discord-image-uploader/internal/caption"
+	"discord-image-uploader/internal/destination"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type BotClient struct {
+	name      string
+	token     string
+	session   *discordgo.Session
+	channelID string
+	embed     EmbedOptions
+	thread    ThreadOptions
+	caps      destination.Capabilities
+}
+
+type sharedSession struct {
+	session  *discordgo.Session
+	refs     int
+	commands *commandHandler
+	guilds   map[string]bool
+}
+
+// Destinations using the same bot token share one gateway session.
+var (
+	sessions     = make(map[string]*sharedSession)
+	sessionMutex sync.Mutex
+)
+
+func NewBotClient(token, channelID string, opts Options) (*BotClient, error) {
+	baseURL, err := normalizeAPIBaseURL(opts.APIBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyAPIBaseURL(baseURL); err != nil {
+		return nil, err
+	}
+
+	proxy, err := parseProxy(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := acquireSession(token, opts.Timeouts, proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BotClient{
+		name:      opts.Name,
+		token:     token,
+		session:   session,
+		channelID: channelID,
+		embed:     opts.Embed,
+		thread:    opts.Thread,
+		caps:      newCapabilities(0),
+	}, nil
+}
+
+// acquireSession returns the session of token. The timeouts and proxy of
+// the first caller apply to all destinations sharing it.
+func acquireSession(token string, timeouts Timeouts, proxy *url.URL) (*discordgo.Session, error) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	if shared, exists := sessions[token]; exists {
+		shared.refs++
+		return shared.session, nil
+	}
+
+	session, err := discordgo.New("Bot " + token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Discord session: %w", err)
+	}
+
+	// discordgo still waits for exhausted buckets on its own, but a 429
+	// is handed back to us instead of being retried in a blocking loop.
+	session.ShouldRetryOnRateLimit = false
+	session.Client = newHTTPClient(timeouts, proxy)
+	session.Dialer = newGatewayDialer(timeouts, proxy)
+
+	err = session.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Discord session: %w", err)
+	}
+
+	sessions[token] = &sharedSession{session: session, refs: 1, guilds: make(map[string]bool)}
+	return session, nil
+}
+
+func releaseSession(token string) error {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	shared, exists := sessions[token]
+	if !exists {
+		return nil
+	}
+
+	shared.refs--
+	if shared.refs > 0 {
+		return nil
+	}
+
+	delete(sessions, token)
+	return shared.session.Close()
+}
+
+func (c *BotClient) Name() string {
+	return c.name
+}
+
+func (c *BotClient) Close() error {
+	return releaseSession(c.token)
+}
+
+// Capabilities reports the limits detected by Test, Discord's defaults
+// before that.
+func (c *BotClient) Capabilities() destination.Capabilities {
+	return c.caps
+}
+
+func (c *BotClient) Upload(ctx context.Context, filePath string, message destination.Message) (*destination.Result, error) {
+	result, err := c.send(ctx, []string{filePath}, message)
+	if err != nil {
+		return result, fmt.Errorf("failed to upload file %s: %w", filePath, err)
+	}
+
+	log.Printf("Successfully uploaded: %s", filepath.Base(filePath))
+	return result, nil
+}
+
+func (c *BotClient) UploadBatch(ctx context.Context, filePaths []string, message destination.Message) (*destination.Result, error) {
+	result, err := c.send(ctx, filePaths, message)
+	if err != nil {
+		return result, fmt.Errorf("failed to upload batch: %w", err)
+	}
+
+	log.Printf("Successfully uploaded batch of %d files", countSent(result))
+	return result, nil
+}
+
+func (c *BotClient) send(ctx context.Context, filePaths []string, msg destination.Message) (*destination.Result, error) {
+	uploads, skipped := openUploads(filePaths)
+	defer closeUploads(uploads)
+
+	if len(uploads) == 0 {
+		return &destination.Result{Files: skipped}, nil
+	}
+
+	data := buildMessage(uploads, msg, c.embed)
+
+	if msg.ThreadID == "" && msg.ThreadName != "" && c.thread.Forum {
+		return c.sendForumPost(ctx, msg.ThreadName, data, uploads, skipped)
+	}
+
+	channelID := c.channelID
+	if msg.ThreadID != "" {
+		channelID = msg.ThreadID
+	} else if msg.ThreadName != "" {
+		thread, err := c.session.ThreadStart(c.channelID, msg.ThreadName, discordgo.ChannelTypeGuildPublicThread, c.thread.AutoArchiveMinutes, discordgo.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create thread %q: %w", msg.ThreadName, convertRateLimitError(err))
+		}
+		log.Printf("Created thread %q (%s)", msg.ThreadName, thread.ID)
+		channelID = thread.ID
+	}
+
+	message, err := c.sendMessage(ctx, channelID, data, msg.Nonce)
+	if err != nil {
+		err = convertThreadError(convertRateLimitError(err))
+		if msg.ThreadID == "" && channelID != c.channelID {
+			// The thread exists now, so hand it back for the retry.
+			return &destination.Result{ChannelID: channelID, ThreadID: channelID}, err
+		}
+		return nil, err
+	}
+
+	result := newUploadResult(message, uploads, skipped)
+	if channelID != c.channelID {
+		result.ThreadID = channelID
+	}
+	return result, nil
+}
+
+// nonceMessage adds the nonce fields discordgo's MessageSend lacks.
+type nonceMessage struct {
+	*discordgo.MessageSend
+	Nonce        string `json:"nonce"`
+	EnforceNonce bool   `json:"enforce_nonce"`
+}
+
+// sendMessage posts data with enforce_nonce set, so Discord answers a
+// repeated send with the same nonce with the message created first instead
+// of posting it again.
+func (c *BotClient) sendMessage(ctx context.Context, channelID string, data *discordgo.MessageSend, nonce string) (*discordgo.Message, error) {
+	if nonce == "" {
+		return c.session.ChannelMessageSendComplex(channelID, data, discordgo.WithContext(ctx))
+	}
+
+	for _, embed := range data.Embeds {
+		if embed.Type == "" {
+			embed.Type = discordgo.EmbedTypeRich
+		}
+	}
+
+	payload := nonceMessage{MessageSend: data, Nonce: nonce, EnforceNonce: true}
+	contentType, body, err := discordgo.MultipartBodyWithJSON(payload, data.Files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	endpoint := discordgo.EndpointChannelMessages(channelID)
+	response, err := c.session.RequestRaw("POST", endpoint, contentType, body, endpoint, 0, discordgo.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	var message discordgo.Message
+	if err := json.Unmarshal(response, &message); err != nil {
+		return nil, fmt.Errorf("failed to decode message: %w", err)
+	}
+	return &message, nil
+}
+
+// FindUpload looks through the latest messages of the channel for one the
+// bot posted with exactly the attachments of filePaths. Discord doesn't
+// return nonces when reading messages, so the files are compared instead.
+func (c *BotClient) FindUpload(ctx context.Context, threadID string, filePaths []string, since time.Time) (*destination.Result, error) {
+	channelID := c.channelID
+	if threadID != "" {
+		channelID = threadID
+	}
+
+	user, err := c.session.User("@me", discordgo.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up bot user: %w", err)
+	}
+
+	messages, err := c.session.ChannelMessages(channelID, 100, "", "", "", discordgo.WithContext(ctx))
+	if err != nil {
+		return nil, convertThreadError(convertRateLimitError(err))
+	}
+
+	uploads := make([]*fileUpload, len(filePaths))
+	for i, filePath := range filePaths {
+		uploads[i] = &fileUpload{path: filePath, name: attachmentName(filePath)}
+	}
+
+	for _, message := range messages {
+		if message.Author == nil || message.Author.ID != user.ID || message.Timestamp.Before(since) {
+			continue
+		}
+
+		if hasAttachments(message, uploads) {
+			result := newUploadResult(message, uploads, nil)
+			result.ThreadID = threadID
+			return result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func hasAttachments(message *discordgo.Message, uploads []*fileUpload) bool {
+	if len(message.Attachments) != len(uploads) {
+		return false
+	}
+
+	names := make(map[string]int)
+	for _, attachment := range message.Attachments {
+		names[attachment.Filename]++
+	}
+	for _, upload := range uploads {
+		if names[upload.name] == 0 {
+			return false
+		}
+		names[upload.name]--
+	}
+	return true
+}
+
+// sendForumPost creates a forum post whose starter message carries the
+// upload. The starter message shares its ID with the thread.
+func (c *BotClient) sendForumPost(ctx context.Context, name string, data *discordgo.MessageSend, uploads []*fileUpload, skipped []destination.FileResult) (*destination.Result, error) {
+	thread, err := c.session.ForumThreadStartComplex(c.channelID, &discordgo.ThreadStart{
+		Name:                name,
+		AutoArchiveDuration: c.thread.AutoArchiveMinutes,
+		AppliedTags:         c.thread.AppliedTags,
+	}, data, discordgo.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create forum post %q: %w", name, convertRateLimitError(err))
+	}
+	log.Printf("Created forum post %q (%s)", name, thread.ID)
+
+	message, err := c.session.ChannelMessage(thread.ID, thread.ID, discordgo.WithContext(ctx))
+	if err != nil {
+		log.Printf("Warning: failed to fetch starter message of forum post %s: %v", thread.ID, err)
+		message = &discordgo.Message{ID: thread.ID, ChannelID: thread.ID}
+	}
+
+	result := newUploadResult(message, uploads, skipped)
+	result.ThreadID = thread.ID
+	return result, nil
+}
+
+// Test checks access to the channel and detects the upload limits of its
+// guild, which depend on the guild's boost tier.
+func (c *BotClient) Test(ctx context.Context) error {
+	channel, err := c.session.Channel(c.channelID, discordgo.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to access channel %s: %w", c.channelID, err)
+	}
+
+	log.Printf("Successfully connected to Discord channel: %s", c.channelID)
+
+	if channel.GuildID == "" {
+		return nil
+	}
+
+	guild, err := c.session.Guild(channel.GuildID, discordgo.WithContext(ctx))
+	if err != nil {
+		log.Printf("Warning: failed to look up guild %s, using default upload limits: %v", channel.GuildID, err)
+		return nil
+	}
+
+	c.caps = newCapabilities(guildMaxFileBytes(guild.PremiumTier))
+	log.Printf("Guild %q has boost tier %d, upload limit is %s per file", guild.Name, guild.PremiumTier, caption.HumanizeBytes(c.caps.MaxFileBytes))
+	return nil
+}
+
+func (c *BotClient) RemoveAttachment(ctx context.Context, ref destination.MessageRef, filePath string) error {
+	message, err := c.session.ChannelMessage(ref.ChannelID, ref.MessageID, discordgo.WithContext(ctx))
+	if err != nil {
+		return convertMessageError(convertRateLimitError(err))
+	}
+
+	edit, found := planEdit(message, ref, filePath)
+	if !found {
+		return nil
+	}
+
+	if len(edit.attachments) == 0 {
+		err = c.session.ChannelMessageDelete(ref.ChannelID, ref.MessageID, discordgo.WithContext(ctx))
+		if err != nil {
+			return convertMessageError(convertRateLimitError(err))
+		}
+		log.Printf("Deleted message %s for %s", ref.MessageID, filepath.Base(filePath))
+		return nil
+	}
+
+	_, err = c.session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:          ref.MessageID,
+		Channel:     ref.ChannelID,
+		Embeds:      &edit.embeds,
+		Attachments: &edit.attachments,
+	}, discordgo.WithContext(ctx))
+	if err != nil {
+		return convertMessageError(convertRateLimitError(err))
+	}
+
+	log.Printf("Removed %s from message %s", filepath.Base(filePath), ref.MessageID)
+	return nil
+}
+
+func (c *BotClient) ReplaceAttachment(ctx context.Context, ref destination.MessageRef, filePath string) (*destination.Result, error) {
+	message, err := c.session.ChannelMessage(ref.ChannelID, ref.MessageID, discordgo.WithContext(ctx))
+	if err != nil {
+		return nil, convertMessageError(convertRateLimitError(err))
+	}
+
+	edit, found := planEdit(message, ref, filePath)
+	if !found {
+		return nil, fmt.Errorf("%w: %s is no longer attached to message %s", destination.ErrMessageNotFound, filepath.Base(filePath), ref.MessageID)
+	}
+
+	uploads, skipped := openUploads([]string{filePath})
+	defer closeUploads(uploads)
+
+	if len(uploads) == 0 {
+		return &destination.Result{Files: skipped}, nil
+	}
+
+	edit.replaceWith(uploads[0], c.embed)
+
+	updated, err := c.session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:          ref.MessageID,
+		Channel:     ref.ChannelID,
+		Embeds:      &edit.embeds,
+		Attachments: &edit.attachments,
+		Files: []*discordgo.File{{
+			Name:        uploads[0].name,
+			ContentType: contentType(uploads[0].name),
+			Reader:      uploads[0].file,
+		}},
+	}, discordgo.WithContext(ctx))
+	if err != nil {
+		return nil, convertMessageError(convertRateLimitError(err))
+	}
+
+	log.Printf("Replaced %s on message %s", filepath.Base(filePath), ref.MessageID)
+
+	result := newUploadResult(updated, uploads, skipped)
+	result.ThreadID = ref.ThreadID
+	return result, nil
+}
@@ -0,0 +1,59 @@
+package discord
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"discord-image-uploader/internal/destination"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestBotSendReturnsThreadAfterFailedMessage(t *testing.T) {
+	var threadsCreated int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/channels/c1/threads":
+			threadsCreated++
+			w.Write([]byte(`{"id": "t1", "type": 11}`))
+		case "/api/channels/t1/messages":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message": "Missing Permissions", "code": 50013}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	restoreEndpoints(t)
+	setEndpoints(server.URL + "/api/")
+
+	session, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Client = server.Client()
+
+	file := filepath.Join(t.TempDir(), "a.png")
+	if err := os.WriteFile(file, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &BotClient{name: "bot", session: session, channelID: "c1"}
+	result, err := client.Upload(context.Background(), file, destination.Message{ThreadName: "Session", Nonce: "n1"})
+	if err == nil {
+		t.Fatal("upload succeeded although the message was refused")
+	}
+	if result == nil || result.ThreadID != "t1" || result.ChannelID != "t1" || result.MessageID != "" {
+		t.Errorf("result = %+v, want only thread t1", result)
+	}
+	if threadsCreated != 1 {
+		t.Errorf("created %d threads", threadsCreated)
+	}
+}
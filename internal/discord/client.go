@@ -1,277 +1,225 @@
 package discord
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"mime/multipart"
+	"net"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"time"
+
+	"discord-image-uploader/internal/destination"
 
 	"github.com/bwmarrin/discordgo"
 )
 
-type Client struct {
-	session    *discordgo.Session
-	channelID  string
-	webhookURL string
-}
-
-func NewClient(token, channelID string) (*Client, error) {
-	session, err := discordgo.New("Bot " + token)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Discord session: %w", err)
-	}
+const (
+	dialTimeout           = 10 * time.Second
+	responseHeaderTimeout = 60 * time.Second
 
-	err = session.Open()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open Discord session: %w", err)
-	}
+	maxAttachmentsPerMessage = 10
+	defaultMaxFileBytes      = 10 * 1024 * 1024
+	defaultMaxRequestBytes   = 25 * 1024 * 1024
+	tier2MaxFileBytes        = 50 * 1024 * 1024
+	tier3MaxFileBytes        = 100 * 1024 * 1024
+)
 
-	return &Client{
-		session:   session,
-		channelID: channelID,
-	}, nil
+type Options struct {
+	Name            string
+	APIBaseURL      string
+	TestMessage     string
+	SendTestMessage bool
+	// MaxFileBytes replaces the default per-file limit where the real one
+	// can't be detected, i.e. for webhooks.
+	MaxFileBytes int64
+	Embed        EmbedOptions
+	Thread       ThreadOptions
+	Timeouts     Timeouts
+	Proxy        ProxyOptions
 }
 
-func NewWebhookClient(webhookURL string) (*Client, error) {
-	return &Client{
-		webhookURL: webhookURL,
-	}, nil
+type ThreadOptions struct {
+	Forum              bool
+	AppliedTags        []string
+	AutoArchiveMinutes int
 }
 
-func (c *Client) Close() error {
-	if c.session != nil {
-		return c.session.Close()
-	}
-	return nil
-}
+var (
+	_ destination.Destination = (*WebhookClient)(nil)
+	_ destination.Editor      = (*WebhookClient)(nil)
+	_ destination.Destination = (*BotClient)(nil)
+	_ destination.Editor      = (*BotClient)(nil)
+	_ destination.Reconciler  = (*BotClient)(nil)
+)
 
-func (c *Client) UploadImage(filePath string) error {
-	if c.webhookURL != "" {
-		return c.uploadImageViaWebhook(filePath)
-	}
-	return c.uploadImageViaBot(filePath)
+// Timeouts bound the waits of a single request. Zero values fall back to
+// the defaults.
+type Timeouts struct {
+	// Connect covers the TCP connect and the TLS handshake.
+	Connect time.Duration
+	// Read is how long Discord may take to answer once the request was sent,
+	// and how long sending the body may stall.
+	Read time.Duration
 }
 
-func (c *Client) uploadImageViaBot(filePath string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to open file %s: %w", filePath, err)
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Connect <= 0 {
+		t.Connect = dialTimeout
 	}
-	defer file.Close()
-
-	fileName := filepath.Base(filePath)
-
-	_, err = c.session.ChannelFileSend(c.channelID, fileName, file)
-	if err != nil {
-		return fmt.Errorf("failed to upload file %s: %w", filePath, err)
+	if t.Read <= 0 {
+		t.Read = responseHeaderTimeout
 	}
-
-	log.Printf("Successfully uploaded: %s", fileName)
-	return nil
+	return t
 }
 
-func (c *Client) uploadImageViaWebhook(filePath string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to open file %s: %w", filePath, err)
-	}
-	defer file.Close()
-
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
-
-	fileName := filepath.Base(filePath)
-	part, err := writer.CreateFormFile("file", fileName)
-	if err != nil {
-		return fmt.Errorf("failed to create form file: %w", err)
-	}
-
-	_, err = io.Copy(part, file)
-	if err != nil {
-		return fmt.Errorf("failed to copy file data: %w", err)
-	}
-
-	err = writer.Close()
-	if err != nil {
-		return fmt.Errorf("failed to close multipart writer: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", c.webhookURL, &body)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send webhook request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+// newHTTPClient returns the client shared by all requests of a destination.
+// There is no overall timeout because large uploads on slow links may take
+// a while; stalled connections are caught by the timeouts, and callers
+// cancel requests through their context.
+func newHTTPClient(timeouts Timeouts, proxy *url.URL) *http.Client {
+	timeouts = timeouts.withDefaults()
+
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Connect,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: proxyFunc(proxy),
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, address)
+				if err != nil {
+					return nil, err
+				}
+				return &writeTimeoutConn{Conn: conn, timeout: timeouts.Read}, nil
+			},
+			TLSHandshakeTimeout:   timeouts.Connect,
+			ResponseHeaderTimeout: timeouts.Read,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   2,
+		},
 	}
+}
 
-	log.Printf("Successfully uploaded via webhook: %s", fileName)
-	return nil
+// writeTimeoutConn fails writes that make no progress for timeout, so an
+// upload stalled in the middle of its body doesn't block forever. Reads are
+// left to ResponseHeaderTimeout, idle pooled connections wait in a read.
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
 }
 
-func (c *Client) UploadImages(filePaths []string) error {
-	if c.webhookURL != "" {
-		return c.uploadImagesViaWebhook(filePaths)
+func (c *writeTimeoutConn) Write(p []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
 	}
-	return c.uploadImagesViaBot(filePaths)
+	return c.Conn.Write(p)
 }
 
-func (c *Client) uploadImagesViaBot(filePaths []string) error {
-	var files []*discordgo.File
-
-	for _, filePath := range filePaths {
-		file, err := os.Open(filePath)
-		if err != nil {
-			log.Printf("Failed to open file %s: %v", filePath, err)
-			continue
-		}
+// newUploadResult describes the created message and the outcome of every
+// file that was part of the request.
+func newUploadResult(message *discordgo.Message, uploads []*fileUpload, skipped []destination.FileResult) *destination.Result {
+	result := &destination.Result{
+		MessageID: message.ID,
+		ChannelID: message.ChannelID,
+		WebhookID: message.WebhookID,
+	}
 
-		fileName := filepath.Base(filePath)
-		files = append(files, &discordgo.File{
-			Name:   fileName,
-			Reader: file,
+	for _, attachment := range message.Attachments {
+		result.Attachments = append(result.Attachments, destination.Attachment{
+			ID:       attachment.ID,
+			Filename: attachment.Filename,
+			URL:      attachment.URL,
 		})
 	}
 
-	if len(files) == 0 {
-		return fmt.Errorf("no valid files to upload")
-	}
+	for i, upload := range uploads {
+		// Matching by position is only safe if Discord kept every file.
+		index := i
+		if len(result.Attachments) != len(uploads) {
+			index = -1
+		}
 
-	_, err := c.session.ChannelMessageSendComplex(c.channelID, &discordgo.MessageSend{
-		Files: files,
-	})
+		file := destination.FileResult{
+			Path:       upload.path,
+			Status:     destination.FileSent,
+			Attachment: result.AttachmentFor(upload.name, index),
+		}
 
-	for _, file := range files {
-		if closer, ok := file.Reader.(interface{ Close() error }); ok {
-			closer.Close()
+		// An empty attachment list means the message wasn't returned to us,
+		// not that every file was dropped.
+		if len(result.Attachments) > 0 && file.Attachment.ID == "" {
+			file.Status = destination.FileFailed
+			file.Reason = "attachment missing from Discord's response"
 		}
-	}
 
-	if err != nil {
-		return fmt.Errorf("failed to upload batch: %w", err)
+		result.Files = append(result.Files, file)
 	}
 
-	log.Printf("Successfully uploaded batch of %d files", len(files))
-	return nil
+	result.Files = append(result.Files, skipped...)
+	return result
 }
 
-func (c *Client) uploadImagesViaWebhook(filePaths []string) error {
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
-
-	for _, filePath := range filePaths {
-		file, err := os.Open(filePath)
-		if err != nil {
-			log.Printf("Failed to open file %s: %v", filePath, err)
-			continue
-		}
-		defer file.Close()
-
-		fileName := filepath.Base(filePath)
-		part, err := writer.CreateFormFile("file", fileName)
-		if err != nil {
-			log.Printf("Failed to create form file for %s: %v", filePath, err)
-			continue
-		}
-
-		_, err = io.Copy(part, file)
-		if err != nil {
-			log.Printf("Failed to copy file data for %s: %v", filePath, err)
-			continue
+func countSent(result *destination.Result) int {
+	sent := 0
+	for _, file := range result.Files {
+		if file.Status == destination.FileSent {
+			sent++
 		}
 	}
+	return sent
+}
 
-	err := writer.Close()
-	if err != nil {
-		return fmt.Errorf("failed to close multipart writer: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", c.webhookURL, &body)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+// newCapabilities returns the limits for a per-file limit of maxFileBytes,
+// or Discord's default if it is 0. A request always allows at least one
+// file of the maximum size.
+func newCapabilities(maxFileBytes int64) destination.Capabilities {
+	if maxFileBytes <= 0 {
+		maxFileBytes = defaultMaxFileBytes
 	}
 
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send webhook request: %w", err)
+	maxBytes := int64(defaultMaxRequestBytes)
+	if maxFileBytes > maxBytes {
+		maxBytes = maxFileBytes
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	return destination.Capabilities{
+		MaxAttachments:  maxAttachmentsPerMessage,
+		MaxFileBytes:    maxFileBytes,
+		MaxBytes:        maxBytes,
+		CanEditMessages: true,
 	}
-
-	log.Printf("Successfully uploaded batch of %d files via webhook", len(filePaths))
-	return nil
 }
 
-func (c *Client) TestConnection(testMessage string, sendTest bool) error {
-	if c.webhookURL != "" {
-		return c.testWebhookConnection(testMessage, sendTest)
+// guildMaxFileBytes returns the per-file upload limit of a guild with the
+// given boost tier.
+func guildMaxFileBytes(tier discordgo.PremiumTier) int64 {
+	switch tier {
+	case discordgo.PremiumTier2:
+		return tier2MaxFileBytes
+	case discordgo.PremiumTier3:
+		return tier3MaxFileBytes
+	default:
+		return defaultMaxFileBytes
 	}
-	return c.testBotConnection()
 }
 
-func (c *Client) testBotConnection() error {
-	_, err := c.session.Channel(c.channelID)
-	if err != nil {
-		return fmt.Errorf("failed to access channel %s: %w", c.channelID, err)
+// convertThreadError marks Discord's "Unknown Channel" answer so the
+// uploader can forget a cached thread that no longer exists.
+func convertThreadError(err error) error {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownChannel {
+		return fmt.Errorf("%w: %v", destination.ErrThreadNotFound, err)
 	}
-
-	log.Printf("Successfully connected to Discord channel: %s", c.channelID)
-	return nil
+	return err
 }
 
-func (c *Client) testWebhookConnection(testMessage string, sendTest bool) error {
-	if !sendTest {
-		log.Printf("Skipping webhook test message")
-		return nil
-	}
-
-	payload := map[string]string{
-		"content": testMessage,
-	}
-
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("failed to marshal test payload: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", c.webhookURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create test request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send test webhook request: %w", err)
+func convertMessageError(err error) error {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMessage {
+		return fmt.Errorf("%w: %v", destination.ErrMessageNotFound, err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("webhook test returned status %d", resp.StatusCode)
-	}
-
-	log.Printf("Successfully tested webhook connection")
-	return nil
+	return err
 }
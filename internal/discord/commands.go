@@ -0,0 +1,230 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"discord-image-uploader/internal/control"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Keeps the status answer well below Discord's message length limit.
+const maxErrorLength = 1000
+
+type CommandOptions struct {
+	AllowedRoleIDs []string
+	AllowedUserIDs []string
+}
+
+var uploaderCommand = &discordgo.ApplicationCommand{
+	Name:        "uploader",
+	Description: "Control the image uploader",
+	Options: []*discordgo.ApplicationCommandOption{
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "status", Description: "Show queue length, last upload and errors"},
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "pause", Description: "Stop processing the queue"},
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "resume", Description: "Start processing the queue again"},
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "flush", Description: "Upload the queue now"},
+		{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "retry", Description: "Retry failed files"},
+	},
+}
+
+type commandHandler struct {
+	controller control.Controller
+	opts       CommandOptions
+}
+
+// EnableCommands registers /uploader in the guild of the client's channel
+// and hands its invocations to controller. Destinations sharing a bot
+// session share one handler.
+func (c *BotClient) EnableCommands(ctx context.Context, controller control.Controller, opts CommandOptions) error {
+	channel, err := c.session.Channel(c.channelID, discordgo.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to look up channel %s: %w", c.channelID, err)
+	}
+	if channel.GuildID == "" {
+		return fmt.Errorf("channel %s is not part of a guild", c.channelID)
+	}
+
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	shared := sessions[c.token]
+	if shared.guilds[channel.GuildID] {
+		return nil
+	}
+
+	user, err := c.session.User("@me", discordgo.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to look up bot user: %w", err)
+	}
+
+	_, err = c.session.ApplicationCommandCreate(user.ID, channel.GuildID, uploaderCommand, discordgo.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to register commands: %w", err)
+	}
+	shared.guilds[channel.GuildID] = true
+
+	if shared.commands == nil {
+		shared.commands = &commandHandler{controller: controller, opts: opts}
+		c.session.AddHandler(shared.commands.handle)
+	}
+
+	log.Printf("Registered /uploader commands in guild %s", channel.GuildID)
+	return nil
+}
+
+func (h *commandHandler) handle(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+
+	data := i.ApplicationCommandData()
+	if data.Name != uploaderCommand.Name || len(data.Options) == 0 {
+		return
+	}
+
+	if !h.isAllowed(i) {
+		h.respond(s, i, "You are not allowed to control the uploader.")
+		return
+	}
+
+	// Commands may have to wait for a running batch, which easily takes
+	// longer than the three seconds Discord gives for an answer.
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		log.Printf("Failed to acknowledge command: %v", err)
+		return
+	}
+
+	subcommand := data.Options[0].Name
+	log.Printf("Running /uploader %s for %s", subcommand, interactionUserID(i))
+
+	content := h.run(subcommand)
+	_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content})
+	if err != nil {
+		log.Printf("Failed to answer /uploader %s: %v", subcommand, err)
+	}
+}
+
+func (h *commandHandler) run(subcommand string) string {
+	switch subcommand {
+	case "status":
+		return formatStatus(h.controller.Status())
+	case "pause":
+		h.controller.Pause()
+		return "Uploads paused."
+	case "resume":
+		h.controller.Resume()
+		return "Uploads resumed."
+	case "flush":
+		h.controller.Flush()
+		return fmt.Sprintf("Queue flushed, %d files left.", h.controller.Status().QueueLength)
+	case "retry":
+		return fmt.Sprintf("Retrying %d failed files.", h.controller.Retry())
+	default:
+		return fmt.Sprintf("Unknown command %q.", subcommand)
+	}
+}
+
+func (h *commandHandler) respond(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to answer command: %v", err)
+	}
+}
+
+func (h *commandHandler) isAllowed(i *discordgo.InteractionCreate) bool {
+	return isAllowed(interactionUserID(i), i.Member, h.opts.AllowedUserIDs, h.opts.AllowedRoleIDs)
+}
+
+// isAllowed reports whether the user is listed or has one of the listed
+// roles. Roles are only known for members of a guild.
+func isAllowed(userID string, member *discordgo.Member, userIDs, roleIDs []string) bool {
+	for _, allowed := range userIDs {
+		if userID == allowed {
+			return true
+		}
+	}
+
+	if member == nil {
+		return false
+	}
+
+	for _, role := range member.Roles {
+		for _, allowed := range roleIDs {
+			if role == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
+
+func formatStatus(status control.Status) string {
+	var lines []string
+
+	queue := fmt.Sprintf("Queue: %d files", status.QueueLength)
+	if status.Paused {
+		queue += " (paused)"
+	}
+	lines = append(lines, queue)
+
+	if status.LastUpload.IsZero() {
+		lines = append(lines, "Last upload: none yet")
+	} else {
+		lines = append(lines, "Last upload: "+discordTimestamp(status.LastUpload))
+	}
+
+	lines = append(lines, fmt.Sprintf("Failed files: %d", status.FailedFiles))
+	if status.UnresolvedFiles > 0 {
+		lines = append(lines, fmt.Sprintf("Unresolved files: %d (check the channel, then use retry to post them again)", status.UnresolvedFiles))
+	}
+
+	if status.LastError != "" {
+		lastError := status.LastError
+		if runes := []rune(lastError); len(runes) > maxErrorLength {
+			lastError = string(runes[:maxErrorLength-1]) + "…"
+		}
+		lines = append(lines, fmt.Sprintf("Last error (%s): %s", discordTimestamp(status.LastErrorAt), lastError))
+	}
+
+	var names []string
+	for name := range status.RateLimited {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("Rate limited on %s until %s", name, discordTimestamp(status.RateLimited[name])))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// discordTimestamp renders t in the reader's local time zone.
+func discordTimestamp(t time.Time) string {
+	return fmt.Sprintf("<t:%d:R>", t.Unix())
+}
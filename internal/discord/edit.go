@@ -0,0 +1,101 @@
+package discord
+
+import (
+	"path/filepath"
+	"strings"
+
+	"discord-image-uploader/internal/destination"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// messageEdit describes how a posted message looks after one of its
+// attachments was taken off or swapped. It is shared by the bot and the
+// webhook path, which only differ in the endpoints they call.
+type messageEdit struct {
+	attachments []*discordgo.MessageAttachment
+	embeds      []*discordgo.MessageEmbed
+	// embedIndex is the position of the embed that belonged to the removed
+	// attachment, or -1 if it had none.
+	embedIndex int
+}
+
+// planEdit takes the attachment of ref off message. It returns false if
+// the attachment is no longer part of the message.
+func planEdit(message *discordgo.Message, ref destination.MessageRef, filePath string) (*messageEdit, bool) {
+	target := findAttachment(message, ref, filePath)
+	if target == nil {
+		return nil, false
+	}
+
+	// Empty lists instead of nil, so the edit clears them rather than
+	// leaving them untouched.
+	edit := &messageEdit{
+		attachments: []*discordgo.MessageAttachment{},
+		embeds:      []*discordgo.MessageEmbed{},
+		embedIndex:  -1,
+	}
+	for _, attachment := range message.Attachments {
+		if attachment.ID != target.ID {
+			edit.attachments = append(edit.attachments, attachment)
+		}
+	}
+
+	for _, embed := range message.Embeds {
+		if embedBelongsTo(embed, target, filePath) {
+			edit.embedIndex = len(edit.embeds)
+			continue
+		}
+		edit.embeds = append(edit.embeds, embed)
+	}
+
+	return edit, true
+}
+
+// replaceWith adds upload as the new attachment. The ID "0" refers to the
+// first file part of the request. The embed is rebuilt only if the old
+// attachment had one.
+func (e *messageEdit) replaceWith(upload *fileUpload, opts EmbedOptions) {
+	e.attachments = append(e.attachments, &discordgo.MessageAttachment{
+		ID:       "0",
+		Filename: upload.name,
+	})
+
+	if e.embedIndex < 0 {
+		return
+	}
+
+	embed := buildEmbed(upload, opts)
+	e.embeds = append(e.embeds[:e.embedIndex], append([]*discordgo.MessageEmbed{embed}, e.embeds[e.embedIndex:]...)...)
+}
+
+// findAttachment looks the attachment up by ID. Deliveries recorded before
+// attachment IDs were stored only have the file name to go by.
+func findAttachment(message *discordgo.Message, ref destination.MessageRef, filePath string) *discordgo.MessageAttachment {
+	for _, attachment := range message.Attachments {
+		if ref.AttachmentID != "" && attachment.ID == ref.AttachmentID {
+			return attachment
+		}
+	}
+
+	if ref.AttachmentID != "" {
+		return nil
+	}
+
+	name := attachmentName(filePath)
+	for _, attachment := range message.Attachments {
+		if attachment.Filename == name {
+			return attachment
+		}
+	}
+	return nil
+}
+
+// embedBelongsTo matches embeds created by buildEmbed. Discord rewrites
+// attachment:// image URLs to CDN URLs containing the attachment ID.
+func embedBelongsTo(embed *discordgo.MessageEmbed, attachment *discordgo.MessageAttachment, filePath string) bool {
+	if embed.Image != nil && strings.Contains(embed.Image.URL, "/"+attachment.ID+"/") {
+		return true
+	}
+	return embed.Title == filepath.Base(filePath)
+}
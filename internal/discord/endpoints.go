@@ -0,0 +1,103 @@
+package discord
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const DefaultAPIBaseURL = "https://discord.com/api/v9/"
+
+var (
+	endpointBase  string
+	endpointMutex sync.Mutex
+)
+
+func normalizeAPIBaseURL(baseURL string) (string, error) {
+	if baseURL == "" {
+		return DefaultAPIBaseURL, nil
+	}
+
+	parsed, err := url.Parse(baseURL)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return "", fmt.Errorf("invalid Discord API base URL: %s", baseURL)
+	}
+
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+
+	return baseURL, nil
+}
+
+// applyAPIBaseURL points discordgo's REST endpoints at baseURL. discordgo
+// keeps its endpoints in package variables, so every session in the process
+// shares one base URL and a second, different one is rejected.
+func applyAPIBaseURL(baseURL string) error {
+	endpointMutex.Lock()
+	defer endpointMutex.Unlock()
+
+	if endpointBase != "" && endpointBase != baseURL {
+		return fmt.Errorf("API base URL %s conflicts with %s already used by another Discord client", baseURL, endpointBase)
+	}
+
+	endpointBase = baseURL
+	setEndpoints(baseURL)
+	return nil
+}
+
+// setEndpoints rebases every endpoint variable discordgo derives from
+// EndpointAPI. The endpoint functions read these variables when called,
+// so they follow along.
+func setEndpoints(baseURL string) {
+	discordgo.EndpointAPI = baseURL
+	discordgo.EndpointGuilds = baseURL + "guilds/"
+	discordgo.EndpointChannels = baseURL + "channels/"
+	discordgo.EndpointUsers = baseURL + "users/"
+	discordgo.EndpointGateway = baseURL + "gateway"
+	discordgo.EndpointGatewayBot = discordgo.EndpointGateway + "/bot"
+	discordgo.EndpointWebhooks = baseURL + "webhooks/"
+	discordgo.EndpointStickers = baseURL + "stickers/"
+	discordgo.EndpointStageInstances = baseURL + "stage-instances"
+	discordgo.EndpointSKUs = baseURL + "skus"
+	discordgo.EndpointVoice = baseURL + "/voice/"
+	discordgo.EndpointVoiceRegions = discordgo.EndpointVoice + "regions"
+	discordgo.EndpointNitroStickersPacks = baseURL + "/sticker-packs"
+	discordgo.EndpointGuildCreate = baseURL + "guilds"
+	discordgo.EndpointApplications = baseURL + "applications"
+	discordgo.EndpointOAuth2 = baseURL + "oauth2/"
+	discordgo.EndpointOAuth2Applications = discordgo.EndpointOAuth2 + "applications"
+
+	// Deprecated aliases that are still exported.
+	discordgo.EndpointOauth2 = discordgo.EndpointOAuth2
+	discordgo.EndpointOauth2Applications = discordgo.EndpointOAuth2Applications
+}
+
+// rebaseWebhookURL keeps the webhook ID, token and query of webhookURL but
+// moves it under baseURL. URLs that don't look like Discord webhooks are
+// returned unchanged.
+func rebaseWebhookURL(webhookURL, baseURL string) string {
+	if baseURL == DefaultAPIBaseURL {
+		return webhookURL
+	}
+
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		return webhookURL
+	}
+
+	index := strings.Index(parsed.Path, "/webhooks/")
+	if index < 0 {
+		return webhookURL
+	}
+
+	rebased := baseURL + strings.TrimPrefix(parsed.Path[index:], "/")
+	if parsed.RawQuery != "" {
+		rebased += "?" + parsed.RawQuery
+	}
+
+	return rebased
+}
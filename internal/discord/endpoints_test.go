@@ -0,0 +1,114 @@
+package discord
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// stringEndpoints lists every string endpoint discordgo exports.
+func stringEndpoints() map[string]*string {
+	return map[string]*string{
+		"EndpointStatus":             &discordgo.EndpointStatus,
+		"EndpointSm":                 &discordgo.EndpointSm,
+		"EndpointSmActive":           &discordgo.EndpointSmActive,
+		"EndpointSmUpcoming":         &discordgo.EndpointSmUpcoming,
+		"EndpointDiscord":            &discordgo.EndpointDiscord,
+		"EndpointAPI":                &discordgo.EndpointAPI,
+		"EndpointGuilds":             &discordgo.EndpointGuilds,
+		"EndpointChannels":           &discordgo.EndpointChannels,
+		"EndpointUsers":              &discordgo.EndpointUsers,
+		"EndpointGateway":            &discordgo.EndpointGateway,
+		"EndpointGatewayBot":         &discordgo.EndpointGatewayBot,
+		"EndpointWebhooks":           &discordgo.EndpointWebhooks,
+		"EndpointStickers":           &discordgo.EndpointStickers,
+		"EndpointStageInstances":     &discordgo.EndpointStageInstances,
+		"EndpointSKUs":               &discordgo.EndpointSKUs,
+		"EndpointCDN":                &discordgo.EndpointCDN,
+		"EndpointCDNAttachments":     &discordgo.EndpointCDNAttachments,
+		"EndpointCDNAvatars":         &discordgo.EndpointCDNAvatars,
+		"EndpointCDNIcons":           &discordgo.EndpointCDNIcons,
+		"EndpointCDNSplashes":        &discordgo.EndpointCDNSplashes,
+		"EndpointCDNChannelIcons":    &discordgo.EndpointCDNChannelIcons,
+		"EndpointCDNBanners":         &discordgo.EndpointCDNBanners,
+		"EndpointCDNGuilds":          &discordgo.EndpointCDNGuilds,
+		"EndpointCDNRoleIcons":       &discordgo.EndpointCDNRoleIcons,
+		"EndpointVoice":              &discordgo.EndpointVoice,
+		"EndpointVoiceRegions":       &discordgo.EndpointVoiceRegions,
+		"EndpointNitroStickersPacks": &discordgo.EndpointNitroStickersPacks,
+		"EndpointGuildCreate":        &discordgo.EndpointGuildCreate,
+		"EndpointApplications":       &discordgo.EndpointApplications,
+		"EndpointOAuth2":             &discordgo.EndpointOAuth2,
+		"EndpointOAuth2Applications": &discordgo.EndpointOAuth2Applications,
+		"EndpointOauth2":             &discordgo.EndpointOauth2,
+		"EndpointOauth2Applications": &discordgo.EndpointOauth2Applications,
+	}
+}
+
+func restoreEndpoints(t *testing.T) {
+	saved := make(map[string]string)
+	for name, endpoint := range stringEndpoints() {
+		saved[name] = *endpoint
+	}
+
+	t.Cleanup(func() {
+		for name, endpoint := range stringEndpoints() {
+			*endpoint = saved[name]
+		}
+		endpointBase = ""
+	})
+}
+
+func TestSetEndpointsRebasesEveryEndpoint(t *testing.T) {
+	restoreEndpoints(t)
+
+	before := make(map[string]string)
+	for name, endpoint := range stringEndpoints() {
+		before[name] = *endpoint
+	}
+
+	const baseURL = "http://127.0.0.1:8080/api/"
+	setEndpoints(baseURL)
+
+	for name, endpoint := range stringEndpoints() {
+		want := before[name]
+		if strings.HasPrefix(want, DefaultAPIBaseURL) {
+			want = baseURL + strings.TrimPrefix(want, DefaultAPIBaseURL)
+		}
+		if *endpoint != want {
+			t.Errorf("%s = %q, want %q", name, *endpoint, want)
+		}
+	}
+
+	funcs := map[string]string{
+		"EndpointApplication":           discordgo.EndpointApplication("@me"),
+		"EndpointOAuth2Application":     discordgo.EndpointOAuth2Application("@me"),
+		"EndpointOauth2ApplicationsBot": discordgo.EndpointOauth2ApplicationsBot("1"),
+		"EndpointChannelMessages":       discordgo.EndpointChannelMessages("1"),
+		"EndpointWebhookToken":          discordgo.EndpointWebhookToken("1", "token"),
+		"EndpointInvite":                discordgo.EndpointInvite("abc"),
+	}
+	for name, endpoint := range funcs {
+		if !strings.HasPrefix(endpoint, baseURL) {
+			t.Errorf("%s = %q, want it under %s", name, endpoint, baseURL)
+		}
+	}
+}
+
+func TestApplyAPIBaseURLRejectsSecondBase(t *testing.T) {
+	restoreEndpoints(t)
+
+	if err := applyAPIBaseURL("http://127.0.0.1:8080/api/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyAPIBaseURL("http://127.0.0.1:8080/api/"); err != nil {
+		t.Errorf("applying the same base URL again failed: %v", err)
+	}
+	if err := applyAPIBaseURL(DefaultAPIBaseURL); err == nil {
+		t.Error("applying a different base URL succeeded")
+	}
+	if discordgo.EndpointAPI != "http://127.0.0.1:8080/api/" {
+		t.Errorf("EndpointAPI = %q after the rejected base URL", discordgo.EndpointAPI)
+	}
+}
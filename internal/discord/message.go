@@ -0,0 +1,151 @@
+package discord
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"discord-image-uploader/internal/caption"
+	"discord-image-uploader/internal/destination"
+
+	"github.com/bwmarrin/discordgo"
+	_ "golang.org/x/image/webp"
+)
+
+type EmbedOptions struct {
+	Enabled bool
+	Color   int
+}
+
+type fileUpload struct {
+	path string
+	name string
+	file *os.File
+	info os.FileInfo
+}
+
+// openUploads opens all files of a message. Files that can't be opened are
+// left out of the message and reported as skipped.
+func openUploads(filePaths []string) ([]*fileUpload, []destination.FileResult) {
+	var uploads []*fileUpload
+	var skipped []destination.FileResult
+
+	for _, filePath := range filePaths {
+		file, err := os.Open(filePath)
+		if err != nil {
+			log.Printf("Failed to open file %s: %v", filePath, err)
+			skipped = append(skipped, skippedFile(filePath, "failed to open file: %v", err))
+			continue
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			log.Printf("Failed to stat file %s: %v", filePath, err)
+			skipped = append(skipped, skippedFile(filePath, "failed to stat file: %v", err))
+			file.Close()
+			continue
+		}
+
+		uploads = append(uploads, &fileUpload{
+			path: filePath,
+			name: attachmentName(filePath),
+			file: file,
+			info: info,
+		})
+	}
+
+	return uploads, skipped
+}
+
+func skippedFile(filePath, format string, args ...interface{}) destination.FileResult {
+	return destination.FileResult{
+		Path:   filePath,
+		Status: destination.FileSkipped,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+func closeUploads(uploads []*fileUpload) {
+	for _, upload := range uploads {
+		upload.file.Close()
+	}
+}
+
+// buildMessage assembles the message for uploads. It is shared by the bot
+// path and the payload_json of the webhook path.
+func buildMessage(uploads []*fileUpload, msg destination.Message, embed EmbedOptions) *discordgo.MessageSend {
+	message := &discordgo.MessageSend{
+		Content: msg.Content,
+	}
+
+	for _, upload := range uploads {
+		if embed.Enabled {
+			message.Embeds = append(message.Embeds, buildEmbed(upload, embed))
+		}
+
+		message.Files = append(message.Files, &discordgo.File{
+			Name:        upload.name,
+			ContentType: contentType(upload.name),
+			Reader:      upload.file,
+		})
+	}
+
+	return message
+}
+
+func buildEmbed(upload *fileUpload, opts EmbedOptions) *discordgo.MessageEmbed {
+	fields := []*discordgo.MessageEmbedField{
+		{Name: "Folder", Value: filepath.Base(filepath.Dir(upload.path)), Inline: true},
+		{Name: "Size", Value: caption.HumanizeBytes(upload.info.Size()), Inline: true},
+		{Name: "Modified", Value: upload.info.ModTime().Format("2006-01-02 15:04:05"), Inline: true},
+	}
+
+	if width, height, ok := imageDimensions(upload.file); ok {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   "Dimensions",
+			Value:  fmt.Sprintf("%d × %d px", width, height),
+			Inline: true,
+		})
+	}
+
+	return &discordgo.MessageEmbed{
+		Title:     filepath.Base(upload.path),
+		Color:     opts.Color,
+		Timestamp: upload.info.ModTime().Format(time.RFC3339),
+		Image:     &discordgo.MessageEmbedImage{URL: "attachment://" + upload.name},
+		Fields:    fields,
+	}
+}
+
+func imageDimensions(file *os.File) (int, int, bool) {
+	defer file.Seek(0, io.SeekStart)
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return config.Width, config.Height, true
+}
+
+// attachmentName returns the file name as Discord stores it, so that
+// attachment:// references in embeds resolve.
+func attachmentName(filePath string) string {
+	return strings.ReplaceAll(filepath.Base(filePath), " ", "_")
+}
+
+func contentType(fileName string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(fileName)); mimeType != "" {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,120 @@
+package discord
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// multipartBody streams a payload_json part followed by the files straight
+// from disk, so a batch never has to fit into memory.
+type multipartBody struct {
+	boundary string
+	payload  []byte
+	uploads  []*fileUpload
+}
+
+func newMultipartBody(payload interface{}, uploads []*fileUpload) (*multipartBody, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	return &multipartBody{
+		boundary: multipart.NewWriter(io.Discard).Boundary(),
+		payload:  data,
+		uploads:  uploads,
+	}, nil
+}
+
+func (b *multipartBody) ContentType() string {
+	return "multipart/form-data; boundary=" + b.boundary
+}
+
+// ContentLength computes the exact body size by writing the multipart
+// framing to a counter and adding the file sizes instead of their data.
+func (b *multipartBody) ContentLength() (int64, error) {
+	counter := &countingWriter{}
+	err := b.write(counter, func(_ io.Writer, upload *fileUpload) error {
+		counter.n += upload.info.Size()
+		return nil
+	})
+	return counter.n, err
+}
+
+// Reader returns a fresh reader over the body. Data is produced by a
+// goroutine writing into a pipe while the request is being sent.
+func (b *multipartBody) Reader() io.ReadCloser {
+	reader, writer := io.Pipe()
+
+	go func() {
+		err := b.write(writer, func(part io.Writer, upload *fileUpload) error {
+			if _, err := upload.file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+
+			written, err := io.Copy(part, upload.file)
+			if err != nil {
+				return err
+			}
+			if written != upload.info.Size() {
+				return fmt.Errorf("file %s changed size while uploading", upload.path)
+			}
+			return nil
+		})
+		writer.CloseWithError(err)
+	}()
+
+	return reader
+}
+
+func (b *multipartBody) write(w io.Writer, writeFile func(io.Writer, *fileUpload) error) error {
+	writer := multipart.NewWriter(w)
+	if err := writer.SetBoundary(b.boundary); err != nil {
+		return err
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="payload_json"`)
+	header.Set("Content-Type", "application/json")
+
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	if _, err := part.Write(b.payload); err != nil {
+		return err
+	}
+
+	for i, upload := range b.uploads {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files[%d]"; filename="%s"`, i, quoteEscaper.Replace(upload.name)))
+		header.Set("Content-Type", contentType(upload.name))
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return err
+		}
+
+		if err := writeFile(part, upload); err != nil {
+			return fmt.Errorf("failed to write %s: %w", upload.path, err)
+		}
+	}
+
+	return writer.Close()
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
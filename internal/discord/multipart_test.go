@@ -0,0 +1,85 @@
+package discord
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMultipartContentLengthMatchesBody(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for name, size := range map[string]int{"a.png": 0, "b c.jpg": 1, "d\"e.gif": 70000} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	uploads, skipped := openUploads(paths)
+	defer closeUploads(uploads)
+	if len(skipped) != 0 {
+		t.Fatalf("skipped %v", skipped)
+	}
+
+	body, err := newMultipartBody(webhookPayload{Content: "hällo"}, uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	length, err := body.ContentLength()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading twice checks that Reader rewinds the files.
+	for i := 0; i < 2; i++ {
+		data, err := io.ReadAll(body.Reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) != length {
+			t.Fatalf("streamed %d bytes, ContentLength said %d", len(data), length)
+		}
+
+		_, params, err := mime.ParseMediaType(body.ContentType())
+		if err != nil {
+			t.Fatal(err)
+		}
+		form, err := multipart.NewReader(strings.NewReader(string(data)), params["boundary"]).ReadForm(1 << 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(form.File) != len(uploads) || form.Value["payload_json"][0] != `{"content":"hällo"}` {
+			t.Errorf("unexpected form: %d files, payload %q", len(form.File), form.Value["payload_json"])
+		}
+	}
+}
+
+func TestMultipartReaderFailsOnChangedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.png")
+	if err := os.WriteFile(path, []byte("short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	uploads, _ := openUploads([]string{path})
+	defer closeUploads(uploads)
+
+	body, err := newMultipartBody(webhookPayload{}, uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("much longer now"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadAll(body.Reader()); err == nil {
+		t.Error("reading a file that changed size succeeded")
+	}
+}
@@ -0,0 +1,69 @@
+package discord
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProxyOptions routes all Discord traffic, the gateway included, through
+// an HTTP CONNECT or SOCKS5 proxy. Without a URL the proxy settings of the
+// environment (HTTPS_PROXY, NO_PROXY) apply.
+type ProxyOptions struct {
+	URL string
+	// Username and Password override credentials in the URL.
+	Username string
+	Password string
+}
+
+// parseProxy returns the proxy URL with its credentials, or nil if no
+// proxy is configured.
+func parseProxy(opts ProxyOptions) (*url.URL, error) {
+	if opts.URL == "" {
+		return nil, nil
+	}
+
+	parsed, err := url.Parse(opts.URL)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL: %s", opts.URL)
+	}
+
+	// The gateway dialer only knows these two.
+	if parsed.Scheme != "http" && parsed.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected http or socks5", parsed.Scheme)
+	}
+
+	if opts.Username != "" {
+		parsed.User = url.UserPassword(opts.Username, opts.Password)
+	}
+
+	return parsed, nil
+}
+
+func proxyFunc(proxy *url.URL) func(*http.Request) (*url.URL, error) {
+	if proxy == nil {
+		return http.ProxyFromEnvironment
+	}
+	return http.ProxyURL(proxy)
+}
+
+// newGatewayDialer returns the websocket dialer for the gateway, which
+// discordgo doesn't route through the session's HTTP client.
+func newGatewayDialer(timeouts Timeouts, proxy *url.URL) *websocket.Dialer {
+	timeouts = timeouts.withDefaults()
+
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Connect,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &websocket.Dialer{
+		Proxy:            proxyFunc(proxy),
+		NetDialContext:   dialer.DialContext,
+		HandshakeTimeout: 45 * time.Second,
+	}
+}
@@ -0,0 +1,168 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"discord-image-uploader/internal/destination"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Waits shorter than this are absorbed by sleeping; anything longer is
+// reported to the caller as a RateLimitError so it can reschedule.
+const maxRateLimitWait = 5 * time.Second
+
+type rateBucket struct {
+	remaining int
+	resetAt   time.Time
+}
+
+type rateLimiter struct {
+	mutex       sync.Mutex
+	routes      map[string]string
+	buckets     map[string]*rateBucket
+	globalReset time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		routes:  make(map[string]string),
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// acquire waits until route may be used. It gives up early if ctx is done.
+func (r *rateLimiter) acquire(ctx context.Context, route string) error {
+	for {
+		delay, global := r.delay(route)
+		if delay <= 0 {
+			return nil
+		}
+
+		if delay > maxRateLimitWait {
+			return destination.NewRateLimitError(route, delay, global)
+		}
+
+		log.Printf("Rate limit reached for %s, waiting %s", route, delay.Round(time.Millisecond))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *rateLimiter) delay(route string) (time.Duration, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	if r.globalReset.After(now) {
+		return r.globalReset.Sub(now), true
+	}
+
+	bucket, exists := r.buckets[r.bucketKey(route)]
+	if !exists || bucket.remaining > 0 || !bucket.resetAt.After(now) {
+		return 0, false
+	}
+
+	return bucket.resetAt.Sub(now), false
+}
+
+func (r *rateLimiter) bucketKey(route string) string {
+	if hash, exists := r.routes[route]; exists {
+		return hash
+	}
+	return route
+}
+
+// update records the rate limit headers of resp and returns a
+// RateLimitError if the response was a 429.
+func (r *rateLimiter) update(route string, resp *http.Response) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+
+	if hash := resp.Header.Get("X-RateLimit-Bucket"); hash != "" {
+		r.routes[route] = hash
+	}
+
+	key := r.bucketKey(route)
+	bucket, exists := r.buckets[key]
+	if !exists {
+		bucket = &rateBucket{remaining: 1}
+		r.buckets[key] = bucket
+	}
+
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		bucket.remaining = remaining
+	}
+
+	if resetAfter, ok := parseSeconds(resp.Header.Get("X-RateLimit-Reset-After")); ok {
+		bucket.resetAt = now.Add(resetAfter)
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+
+	var body struct {
+		RetryAfter float64 `json:"retry_after"`
+		Global     bool    `json:"global"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	_ = json.Unmarshal(data, &body)
+
+	retryAfter := time.Duration(body.RetryAfter * float64(time.Second))
+	if headerRetry, ok := parseSeconds(resp.Header.Get("Retry-After")); ok && headerRetry > retryAfter {
+		retryAfter = headerRetry
+	}
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+
+	global := body.Global || resp.Header.Get("X-RateLimit-Global") == "true"
+	if global {
+		r.globalReset = now.Add(retryAfter)
+	} else {
+		bucket.remaining = 0
+		bucket.resetAt = now.Add(retryAfter)
+	}
+
+	return destination.NewRateLimitError(route, retryAfter, global)
+}
+
+func parseSeconds(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// convertRateLimitError turns discordgo's rate limit error into ours so
+// callers only have to handle a single type.
+func convertRateLimitError(err error) error {
+	var rlErr *discordgo.RateLimitError
+	if !errors.As(err, &rlErr) || rlErr.RateLimit == nil || rlErr.TooManyRequests == nil {
+		return err
+	}
+
+	return destination.NewRateLimitError(rlErr.URL, rlErr.RetryAfter, false)
+}
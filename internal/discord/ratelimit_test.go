@@ -0,0 +1,139 @@
+package discord
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"discord-image-uploader/internal/destination"
+)
+
+func response(status int, headers map[string]string, body string) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+	for key, value := range headers {
+		resp.Header.Set(key, value)
+	}
+	return resp
+}
+
+func TestRateLimiterTracksBucketHeaders(t *testing.T) {
+	limiter := newRateLimiter()
+
+	err := limiter.update("POST /webhooks/1", response(http.StatusOK, map[string]string{
+		"X-RateLimit-Remaining":   "1",
+		"X-RateLimit-Reset-After": "2.5",
+	}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if delay, _ := limiter.delay("POST /webhooks/1"); delay != 0 {
+		t.Errorf("delay = %s with requests remaining", delay)
+	}
+
+	err = limiter.update("POST /webhooks/1", response(http.StatusOK, map[string]string{
+		"X-RateLimit-Remaining":   "0",
+		"X-RateLimit-Reset-After": "2.5",
+	}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delay, global := limiter.delay("POST /webhooks/1")
+	if global || delay < 2*time.Second || delay > 2500*time.Millisecond {
+		t.Errorf("delay = %s (global %v), want about 2.5s", delay, global)
+	}
+
+	if delay, _ := limiter.delay("POST /webhooks/2"); delay != 0 {
+		t.Errorf("other route is delayed by %s", delay)
+	}
+}
+
+func TestRateLimiterSharesBuckets(t *testing.T) {
+	limiter := newRateLimiter()
+
+	for _, route := range []string{"PATCH /messages", "DELETE /messages"} {
+		err := limiter.update(route, response(http.StatusOK, map[string]string{"X-RateLimit-Bucket": "abc"}, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := limiter.update("PATCH /messages", response(http.StatusOK, map[string]string{
+		"X-RateLimit-Bucket":      "abc",
+		"X-RateLimit-Remaining":   "0",
+		"X-RateLimit-Reset-After": "1",
+	}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if delay, _ := limiter.delay("DELETE /messages"); delay <= 0 {
+		t.Error("route of the same bucket isn't delayed")
+	}
+}
+
+func TestRateLimiterTooManyRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    string
+		retry   time.Duration
+		global  bool
+	}{
+		{"body", nil, `{"retry_after": 1.5}`, 1500 * time.Millisecond, false},
+		{"header wins if longer", map[string]string{"Retry-After": "3"}, `{"retry_after": 1.5}`, 3 * time.Second, false},
+		{"global body", nil, `{"retry_after": 2, "global": true}`, 2 * time.Second, true},
+		{"global header", map[string]string{"X-RateLimit-Global": "true", "Retry-After": "2"}, `{}`, 2 * time.Second, true},
+		{"no retry given", nil, `not json`, time.Second, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newRateLimiter()
+			err := limiter.update("POST /webhooks/1", response(http.StatusTooManyRequests, test.headers, test.body))
+
+			var rateLimitErr *destination.RateLimitError
+			if !errors.As(err, &rateLimitErr) {
+				t.Fatalf("err = %v, want a RateLimitError", err)
+			}
+			if rateLimitErr.RetryAfter != test.retry || rateLimitErr.Global != test.global {
+				t.Errorf("got retry %s global %v, want %s %v", rateLimitErr.RetryAfter, rateLimitErr.Global, test.retry, test.global)
+			}
+
+			delay, global := limiter.delay("POST /webhooks/other")
+			if global != test.global || (test.global && delay <= 0) || (!test.global && delay != 0) {
+				t.Errorf("other route: delay %s global %v", delay, global)
+			}
+			if delay, _ := limiter.delay("POST /webhooks/1"); delay <= 0 {
+				t.Error("limited route isn't delayed")
+			}
+		})
+	}
+}
+
+func TestParseSeconds(t *testing.T) {
+	tests := map[string]time.Duration{
+		"1":     time.Second,
+		"0.25":  250 * time.Millisecond,
+		"2.500": 2500 * time.Millisecond,
+	}
+	for value, want := range tests {
+		if got, ok := parseSeconds(value); !ok || got != want {
+			t.Errorf("parseSeconds(%q) = %s, %v, want %s", value, got, ok, want)
+		}
+	}
+
+	for _, value := range []string{"", "soon"} {
+		if _, ok := parseSeconds(value); ok {
+			t.Errorf("parseSeconds(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"discord-image-uploader/internal/destination"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	approveEmoji = "✅"
+	rejectEmoji  = "❌"
+)
+
+type ReviewOptions struct {
+	// Name is the destination the files are reviewed for.
+	Name           string
+	APIBaseURL     string
+	AllowedUserIDs []string
+	AllowedRoleIDs []string
+	Timeouts       Timeouts
+	Proxy          ProxyOptions
+}
+
+// ReviewClient posts files to a private review channel and turns approve
+// and reject reactions of allowed users into decisions. It shares the bot
+// session of destinations using the same token.
+type ReviewClient struct {
+	token         string
+	session       *discordgo.Session
+	channelID     string
+	guildID       string
+	botID         string
+	opts          ReviewOptions
+	removeHandler func()
+	handler       func(reviewID string, decision destination.Decision)
+	mutex         sync.Mutex
+}
+
+var _ destination.Reviewer = (*ReviewClient)(nil)
+
+func NewReviewClient(ctx context.Context, token, channelID string, opts ReviewOptions) (*ReviewClient, error) {
+	baseURL, err := normalizeAPIBaseURL(opts.APIBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyAPIBaseURL(baseURL); err != nil {
+		return nil, err
+	}
+
+	proxy, err := parseProxy(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := acquireSession(token, opts.Timeouts, proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := session.Channel(channelID, discordgo.WithContext(ctx))
+	if err != nil {
+		releaseSession(token)
+		return nil, fmt.Errorf("failed to access review channel %s: %w", channelID, err)
+	}
+
+	user, err := session.User("@me", discordgo.WithContext(ctx))
+	if err != nil {
+		releaseSession(token)
+		return nil, fmt.Errorf("failed to look up bot user: %w", err)
+	}
+
+	c := &ReviewClient{
+		token:     token,
+		session:   session,
+		channelID: channelID,
+		guildID:   channel.GuildID,
+		botID:     user.ID,
+		opts:      opts,
+	}
+	c.removeHandler = session.AddHandler(c.handleReaction)
+
+	return c, nil
+}
+
+func (c *ReviewClient) Close() error {
+	c.removeHandler()
+	return releaseSession(c.token)
+}
+
+func (c *ReviewClient) OnDecision(handler func(reviewID string, decision destination.Decision)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handler = handler
+}
+
+func (c *ReviewClient) Submit(ctx context.Context, filePath string, message destination.Message) (string, error) {
+	uploads, skipped := openUploads([]string{filePath})
+	defer closeUploads(uploads)
+
+	if len(uploads) == 0 {
+		return "", fmt.Errorf("failed to submit %s for review: %s", filePath, skipped[0].Reason)
+	}
+
+	content := fmt.Sprintf("Review for **%s**: react with %s to publish or %s to reject.", c.opts.Name, approveEmoji, rejectEmoji)
+	if message.Content != "" {
+		content += "\n" + message.Content
+	}
+	if runes := []rune(content); len(runes) > 2000 {
+		content = string(runes[:1999]) + "…"
+	}
+
+	sent, err := c.session.ChannelMessageSendComplex(c.channelID, buildMessage(uploads, destination.Message{Content: content}, EmbedOptions{}), discordgo.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("failed to submit %s for review: %w", filePath, convertRateLimitError(err))
+	}
+
+	// Pre-filled reactions, so reviewers only have to click.
+	for _, emoji := range []string{approveEmoji, rejectEmoji} {
+		if err := c.session.MessageReactionAdd(c.channelID, sent.ID, emoji, discordgo.WithContext(ctx)); err != nil {
+			log.Printf("Warning: failed to add %s to review message %s: %v", emoji, sent.ID, err)
+		}
+	}
+
+	return sent.ID, nil
+}
+
+// Decision checks the reactions on a review message. A reject wins over an
+// approve, so an image is never published by accident.
+func (c *ReviewClient) Decision(ctx context.Context, reviewID string) (destination.Decision, error) {
+	for _, decision := range []destination.Decision{destination.DecisionRejected, destination.DecisionApproved} {
+		users, err := c.session.MessageReactions(c.channelID, reviewID, emojiFor(decision), 100, "", "", discordgo.WithContext(ctx))
+		if err != nil {
+			return destination.DecisionPending, convertMessageError(convertRateLimitError(err))
+		}
+
+		for _, user := range users {
+			if user.ID != c.botID && c.isReviewer(ctx, user.ID, nil) {
+				return decision, nil
+			}
+		}
+	}
+
+	return destination.DecisionPending, nil
+}
+
+func (c *ReviewClient) handleReaction(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	if r.ChannelID != c.channelID || r.UserID == c.botID {
+		return
+	}
+
+	decision := decisionFor(r.Emoji.Name)
+	if decision == destination.DecisionPending {
+		return
+	}
+
+	if !c.isReviewer(context.Background(), r.UserID, r.Member) {
+		log.Printf("Ignoring review reaction of %s, not an allowed reviewer", r.UserID)
+		return
+	}
+
+	c.mutex.Lock()
+	handler := c.handler
+	c.mutex.Unlock()
+
+	if handler != nil {
+		handler(r.MessageID, decision)
+	}
+}
+
+// isReviewer checks the allow lists. The member is fetched when roles are
+// configured but weren't part of the event.
+func (c *ReviewClient) isReviewer(ctx context.Context, userID string, member *discordgo.Member) bool {
+	if member == nil && len(c.opts.AllowedRoleIDs) > 0 && c.guildID != "" {
+		fetched, err := c.session.GuildMember(c.guildID, userID, discordgo.WithContext(ctx))
+		if err == nil {
+			member = fetched
+		}
+	}
+
+	return isAllowed(userID, member, c.opts.AllowedUserIDs, c.opts.AllowedRoleIDs)
+}
+
+func decisionFor(emoji string) destination.Decision {
+	switch emoji {
+	case approveEmoji:
+		return destination.DecisionApproved
+	case rejectEmoji:
+		return destination.DecisionRejected
+	default:
+		return destination.DecisionPending
+	}
+}
+
+func emojiFor(decision destination.Decision) string {
+	if decision == destination.DecisionApproved {
+		return approveEmoji
+	}
+	return rejectEmoji
+}
@@ -0,0 +1,438 @@
+package discord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"discord-image-uploader/internal/destination"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type webhookPayload struct {
+	Content     string                    `json:"content,omitempty"`
+	Embeds      []*discordgo.MessageEmbed `json:"embeds,omitempty"`
+	ThreadName  string                    `json:"thread_name,omitempty"`
+	AppliedTags []string                  `json:"applied_tags,omitempty"`
+}
+
+type webhookEditPayload struct {
+	Embeds      []*discordgo.MessageEmbed      `json:"embeds"`
+	Attachments []*discordgo.MessageAttachment `json:"attachments"`
+}
+
+type WebhookClient struct {
+	name            string
+	webhookURL      string
+	httpClient      *http.Client
+	limiter         *rateLimiter
+	testMessage     string
+	sendTestMessage bool
+	maxFileBytes    int64
+	embed           EmbedOptions
+	thread          ThreadOptions
+}
+
+func NewWebhookClient(webhookURL string, opts Options) (*WebhookClient, error) {
+	baseURL, err := normalizeAPIBaseURL(opts.APIBaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := parseProxy(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookClient{
+		name:            opts.Name,
+		webhookURL:      rebaseWebhookURL(webhookURL, baseURL),
+		httpClient:      newHTTPClient(opts.Timeouts, proxy),
+		limiter:         newRateLimiter(),
+		testMessage:     opts.TestMessage,
+		sendTestMessage: opts.SendTestMessage,
+		maxFileBytes:    opts.MaxFileBytes,
+		embed:           opts.Embed,
+		thread:          opts.Thread,
+	}, nil
+}
+
+func (c *WebhookClient) Name() string {
+	return c.name
+}
+
+func (c *WebhookClient) Close() error {
+	return nil
+}
+
+// Capabilities can't be detected, a webhook doesn't see its guild's boost
+// tier.
+func (c *WebhookClient) Capabilities() destination.Capabilities {
+	return newCapabilities(c.maxFileBytes)
+}
+
+func (c *WebhookClient) Upload(ctx context.Context, filePath string, message destination.Message) (*destination.Result, error) {
+	result, err := c.send(ctx, []string{filePath}, message)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Successfully uploaded via webhook: %s", filepath.Base(filePath))
+	return result, nil
+}
+
+func (c *WebhookClient) UploadBatch(ctx context.Context, filePaths []string, message destination.Message) (*destination.Result, error) {
+	result, err := c.send(ctx, filePaths, message)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Successfully uploaded batch of %d files via webhook", countSent(result))
+	return result, nil
+}
+
+func (c *WebhookClient) send(ctx context.Context, filePaths []string, msg destination.Message) (*destination.Result, error) {
+	uploads, skipped := openUploads(filePaths)
+	defer closeUploads(uploads)
+
+	if len(uploads) == 0 {
+		return &destination.Result{Files: skipped}, nil
+	}
+
+	message := buildMessage(uploads, msg, c.embed)
+	payload := webhookPayload{
+		Content: message.Content,
+		Embeds:  message.Embeds,
+	}
+
+	// Webhooks can't open threads in text channels, only forum posts.
+	if msg.ThreadID == "" && msg.ThreadName != "" && c.thread.Forum {
+		payload.ThreadName = msg.ThreadName
+		payload.AppliedTags = c.thread.AppliedTags
+	}
+
+	body, err := newMultipartBody(payload, uploads)
+	if err != nil {
+		return nil, err
+	}
+
+	contentLength, err := body.ContentLength()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute request size: %w", err)
+	}
+
+	response, err := c.sendWebhookRequest(ctx, body.Reader(), contentLength, body.ContentType(), msg.ThreadID)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload.ThreadName != "" {
+		log.Printf("Created forum post %q (%s)", payload.ThreadName, response.ChannelID)
+	}
+
+	result := newUploadResult(response, uploads, skipped)
+	if msg.ThreadID != "" || payload.ThreadName != "" {
+		result.ThreadID = response.ChannelID
+	}
+	return result, nil
+}
+
+// Test looks the webhook up, which proves that it exists and the token is
+// valid without posting anything. The visible test message is optional.
+func (c *WebhookClient) Test(ctx context.Context) error {
+	var webhook discordgo.Webhook
+	err := c.doRequest(ctx, "GET", c.webhookURL, webhookRoute("GET", c.webhookURL), nil, 0, "", &webhook)
+	if err != nil {
+		return fmt.Errorf("webhook check failed: %w", describeWebhookError(err))
+	}
+
+	log.Printf("Webhook %q is valid (guild %s, channel %s)", webhook.Name, webhook.GuildID, webhook.ChannelID)
+
+	if !c.sendTestMessage {
+		return nil
+	}
+
+	payload := map[string]string{
+		"content": c.testMessage,
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal test payload: %w", err)
+	}
+
+	_, err = c.sendWebhookRequest(ctx, bytes.NewReader(jsonData), int64(len(jsonData)), "application/json", "")
+	if err != nil {
+		return fmt.Errorf("webhook test failed: %w", err)
+	}
+
+	log.Printf("Posted webhook test message")
+	return nil
+}
+
+func (c *WebhookClient) RemoveAttachment(ctx context.Context, ref destination.MessageRef, filePath string) error {
+	message, err := c.sendMessageRequest(ctx, "GET", ref, nil, 0, "")
+	if err != nil {
+		return err
+	}
+
+	edit, found := planEdit(message, ref, filePath)
+	if !found {
+		return nil
+	}
+
+	if len(edit.attachments) == 0 {
+		_, err = c.sendMessageRequest(ctx, "DELETE", ref, nil, 0, "")
+		if err != nil {
+			return err
+		}
+		log.Printf("Deleted webhook message %s for %s", ref.MessageID, filepath.Base(filePath))
+		return nil
+	}
+
+	jsonData, err := json.Marshal(webhookEditPayload{
+		Embeds:      edit.embeds,
+		Attachments: edit.attachments,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal edit payload: %w", err)
+	}
+
+	_, err = c.sendMessageRequest(ctx, "PATCH", ref, bytes.NewReader(jsonData), int64(len(jsonData)), "application/json")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Removed %s from webhook message %s", filepath.Base(filePath), ref.MessageID)
+	return nil
+}
+
+func (c *WebhookClient) ReplaceAttachment(ctx context.Context, ref destination.MessageRef, filePath string) (*destination.Result, error) {
+	message, err := c.sendMessageRequest(ctx, "GET", ref, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+
+	edit, found := planEdit(message, ref, filePath)
+	if !found {
+		return nil, fmt.Errorf("%w: %s is no longer attached to message %s", destination.ErrMessageNotFound, filepath.Base(filePath), ref.MessageID)
+	}
+
+	uploads, skipped := openUploads([]string{filePath})
+	defer closeUploads(uploads)
+
+	if len(uploads) == 0 {
+		return &destination.Result{Files: skipped}, nil
+	}
+
+	edit.replaceWith(uploads[0], c.embed)
+
+	body, err := newMultipartBody(webhookEditPayload{
+		Embeds:      edit.embeds,
+		Attachments: edit.attachments,
+	}, uploads)
+	if err != nil {
+		return nil, err
+	}
+
+	contentLength, err := body.ContentLength()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute request size: %w", err)
+	}
+
+	updated, err := c.sendMessageRequest(ctx, "PATCH", ref, body.Reader(), contentLength, body.ContentType())
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Replaced %s on webhook message %s", filepath.Base(filePath), ref.MessageID)
+
+	result := newUploadResult(updated, uploads, skipped)
+	result.ThreadID = ref.ThreadID
+	return result, nil
+}
+
+// sendWebhookRequest executes the webhook with wait=true so Discord
+// answers with the created message instead of an empty 204.
+func (c *WebhookClient) sendWebhookRequest(ctx context.Context, body io.Reader, contentLength int64, contentType, threadID string) (*discordgo.Message, error) {
+	var message discordgo.Message
+	err := c.doRequest(ctx, "POST", webhookExecuteURL(c.webhookURL, threadID), webhookRoute("POST", c.webhookURL), body, contentLength, contentType, &message)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// sendMessageRequest reads, edits or deletes a message the webhook posted.
+func (c *WebhookClient) sendMessageRequest(ctx context.Context, method string, ref destination.MessageRef, body io.Reader, contentLength int64, contentType string) (*discordgo.Message, error) {
+	requestURL := webhookMessageURL(c.webhookURL, ref.MessageID, ref.ThreadID)
+	route := webhookRoute(method, c.webhookURL) + "/messages"
+
+	var message discordgo.Message
+	err := c.doRequest(ctx, method, requestURL, route, body, contentLength, contentType, &message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s webhook message %s: %w", strings.ToLower(method), ref.MessageID, err)
+	}
+	return &message, nil
+}
+
+// doRequest sends a request to the webhook and decodes a 200 answer into
+// out. A 204 leaves out untouched.
+func (c *WebhookClient) doRequest(ctx context.Context, method, requestURL, route string, body io.Reader, contentLength int64, contentType string, out interface{}) error {
+	err := c.limiter.acquire(ctx, route)
+	if err != nil {
+		closeBody(body)
+		return fmt.Errorf("%w: %w", destination.ErrNotSent, err)
+	}
+
+	var wrote atomic.Bool
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteHeaderField: func(string, []string) { wrote.Store(true) },
+	})
+
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, body)
+	if err != nil {
+		closeBody(body)
+		return fmt.Errorf("failed to create request: %w: %w", destination.ErrNotSent, err)
+	}
+
+	if body != nil {
+		req.ContentLength = contentLength
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil && !wrote.Load() {
+		return fmt.Errorf("failed to send webhook request: %w: %w", destination.ErrNotSent, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send webhook request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	err = c.limiter.update(route, resp)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return webhookError(resp)
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			return fmt.Errorf("failed to decode webhook response: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// closeBody closes body on the paths where it never reaches the transport,
+// which would otherwise close it. A streaming body's writer would block
+// forever without this.
+func closeBody(body io.Reader) {
+	if closer, ok := body.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// describeWebhookError explains the errors a broken webhook URL causes.
+func describeWebhookError(err error) error {
+	var statusErr *webhookStatusError
+	if !errors.As(err, &statusErr) {
+		return err
+	}
+
+	switch statusErr.status {
+	case http.StatusNotFound:
+		return fmt.Errorf("webhook does not exist, it may have been deleted: %w", err)
+	case http.StatusUnauthorized:
+		return fmt.Errorf("webhook token is invalid: %w", err)
+	}
+	return err
+}
+
+type webhookStatusError struct {
+	status  int
+	message string
+	code    int
+}
+
+func (e *webhookStatusError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("webhook returned status %d", e.status)
+	}
+	return fmt.Sprintf("webhook returned status %d: %s (code %d)", e.status, e.message, e.code)
+}
+
+func webhookError(resp *http.Response) error {
+	var apiErr discordgo.APIErrorMessage
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(data, &apiErr) != nil || apiErr.Message == "" {
+		return &webhookStatusError{status: resp.StatusCode}
+	}
+
+	err := &webhookStatusError{status: resp.StatusCode, message: apiErr.Message, code: apiErr.Code}
+	switch apiErr.Code {
+	case discordgo.ErrCodeUnknownChannel:
+		return fmt.Errorf("%w: %v", destination.ErrThreadNotFound, err)
+	case discordgo.ErrCodeUnknownMessage:
+		return fmt.Errorf("%w: %v", destination.ErrMessageNotFound, err)
+	}
+	return err
+}
+
+func webhookExecuteURL(webhookURL, threadID string) string {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		return webhookURL
+	}
+
+	query := parsed.Query()
+	query.Set("wait", "true")
+	if threadID != "" {
+		query.Set("thread_id", threadID)
+	}
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String()
+}
+
+// webhookMessageURL returns the endpoint of a message posted by the
+// webhook. Messages in threads are only found with thread_id set.
+func webhookMessageURL(webhookURL, messageID, threadID string) string {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		return webhookURL + "/messages/" + messageID
+	}
+
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/") + "/messages/" + messageID
+	query := url.Values{}
+	if threadID != "" {
+		query.Set("thread_id", threadID)
+	}
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String()
+}
+
+func webhookRoute(method, webhookURL string) string {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		return method + " " + webhookURL
+	}
+	return method + " " + strings.TrimSuffix(parsed.Path, "/")
+}
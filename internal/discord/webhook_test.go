@@ -0,0 +1,39 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"discord-image-uploader/internal/destination"
+)
+
+func TestDoRequestClosesBodyThatIsNeverSent(t *testing.T) {
+	client, err := NewWebhookClient("https://discord.com/api/webhooks/1/token", Options{Name: "hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, writer := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		_, err := writer.Write([]byte("data"))
+		written <- err
+	}()
+
+	err = client.doRequest(context.Background(), "POST", "://no-scheme", "POST /webhooks/1", reader, 4, "text/plain", nil)
+	if !errors.Is(err, destination.ErrNotSent) {
+		t.Errorf("err = %v, want ErrNotSent", err)
+	}
+
+	select {
+	case err := <-written:
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("write to the body = %v, want ErrClosedPipe", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer of the body is still blocked")
+	}
+}
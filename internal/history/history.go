@@ -12,12 +12,34 @@ import (
 	"time"
 )
 
+// Records written before multiple destinations were supported are treated
+// as delivered to this destination.
+const legacyDestination = "default"
+
+type Delivery struct {
+	MessageID    string    `json:"message_id,omitempty"`
+	ChannelID    string    `json:"channel_id,omitempty"`
+	WebhookID    string    `json:"webhook_id,omitempty"`
+	ThreadID     string    `json:"thread_id,omitempty"`
+	AttachmentID string    `json:"attachment_id,omitempty"`
+	DiscordURL   string    `json:"discord_url,omitempty"`
+	UploadedAt   time.Time `json:"uploaded_at"`
+}
+
 type UploadRecord struct {
-	FilePath   string    `json:"file_path"`
-	FileHash   string    `json:"file_hash"`
-	FileSize   int64     `json:"file_size"`
-	UploadedAt time.Time `json:"uploaded_at"`
-	DiscordURL string    `json:"discord_url,omitempty"`
+	FilePath   string              `json:"file_path"`
+	FileHash   string              `json:"file_hash"`
+	FileSize   int64               `json:"file_size"`
+	UploadedAt time.Time           `json:"uploaded_at"`
+	Deliveries map[string]Delivery `json:"deliveries,omitempty"`
+}
+
+type legacyRecord struct {
+	MessageID    string `json:"message_id"`
+	ChannelID    string `json:"channel_id"`
+	WebhookID    string `json:"webhook_id"`
+	AttachmentID string `json:"attachment_id"`
+	DiscordURL   string `json:"discord_url"`
 }
 
 type History struct {
@@ -41,54 +63,69 @@ func New(historyFile string) (*History, error) {
 	return h, nil
 }
 
-func (h *History) IsUploaded(filePath string) bool {
+// GetDeliveries returns the deliveries recorded for the current content of
+// filePath. Deliveries of an older version of the file are ignored.
+func (h *History) GetDeliveries(filePath string) map[string]Delivery {
 	h.mutex.RLock()
-	defer h.mutex.RUnlock()
+	record, exists := h.records[filePath]
+	h.mutex.RUnlock()
 
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		return false
+	if !exists {
+		return nil
 	}
 
-	hash, err := h.calculateFileHash(filePath)
-	if err != nil {
-		return false
+	fileInfo, err := os.Stat(filePath)
+	if err != nil || record.FileSize != fileInfo.Size() {
+		return nil
 	}
 
-	record, exists := h.records[filePath]
-	if !exists {
-		return false
+	hash, err := HashFile(filePath)
+	if err != nil || record.FileHash != hash {
+		return nil
 	}
 
-	return record.FileHash == hash && record.FileSize == fileInfo.Size()
+	return record.Deliveries
 }
 
-func (h *History) MarkUploaded(filePath string, discordURL string) error {
+func (h *History) MarkDelivered(filePath string, destination string, delivery Delivery) error {
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to get file info: %w", err)
 	}
 
-	hash, err := h.calculateFileHash(filePath)
+	hash, err := HashFile(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to calculate file hash: %w", err)
 	}
 
-	record := UploadRecord{
-		FilePath:   filePath,
-		FileHash:   hash,
-		FileSize:   fileInfo.Size(),
-		UploadedAt: time.Now(),
-		DiscordURL: discordURL,
-	}
+	delivery.UploadedAt = time.Now()
 
 	h.mutex.Lock()
+	record, exists := h.records[filePath]
+	if !exists || record.FileHash != hash || record.FileSize != fileInfo.Size() {
+		record = UploadRecord{
+			FilePath:   filePath,
+			FileHash:   hash,
+			FileSize:   fileInfo.Size(),
+			Deliveries: make(map[string]Delivery),
+		}
+	}
+	record.UploadedAt = delivery.UploadedAt
+	record.Deliveries[destination] = delivery
 	h.records[filePath] = record
 	h.mutex.Unlock()
 
 	return h.save()
 }
 
+func (h *History) GetRecord(filePath string) (UploadRecord, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	record, exists := h.records[filePath]
+	return record, exists
+}
+
 func (h *History) RemoveRecord(filePath string) error {
 	h.mutex.Lock()
 	delete(h.records, filePath)
@@ -97,6 +134,41 @@ func (h *History) RemoveRecord(filePath string) error {
 	return h.save()
 }
 
+// RemoveDelivery forgets the delivery of filePath to destination. The
+// record is dropped once no deliveries are left.
+func (h *History) RemoveDelivery(filePath string, destination string) error {
+	h.mutex.Lock()
+	record, exists := h.records[filePath]
+	if !exists {
+		h.mutex.Unlock()
+		return nil
+	}
+
+	delete(record.Deliveries, destination)
+	if len(record.Deliveries) == 0 {
+		delete(h.records, filePath)
+	} else {
+		h.records[filePath] = record
+	}
+	h.mutex.Unlock()
+
+	return h.save()
+}
+
+// MissingFiles returns the recorded files that no longer exist on disk.
+func (h *History) MissingFiles() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	var missing []string
+	for filePath := range h.records {
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			missing = append(missing, filePath)
+		}
+	}
+	return missing
+}
+
 func (h *History) GetUploadCount() int {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
@@ -127,7 +199,9 @@ func (h *History) CleanupMissingFiles() error {
 	return nil
 }
 
-func (h *History) calculateFileHash(filePath string) (string, error) {
+// HashFile returns the SHA-256 of the file's content, as stored in upload
+// records.
+func HashFile(filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
@@ -148,7 +222,41 @@ func (h *History) load() error {
 		return err
 	}
 
-	return json.Unmarshal(data, &h.records)
+	err = json.Unmarshal(data, &h.records)
+	if err != nil {
+		return err
+	}
+
+	return h.migrateLegacyRecords(data)
+}
+
+func (h *History) migrateLegacyRecords(data []byte) error {
+	var legacy map[string]legacyRecord
+	err := json.Unmarshal(data, &legacy)
+	if err != nil {
+		return err
+	}
+
+	for filePath, record := range h.records {
+		if len(record.Deliveries) > 0 {
+			continue
+		}
+
+		old := legacy[filePath]
+		record.Deliveries = map[string]Delivery{
+			legacyDestination: {
+				MessageID:    old.MessageID,
+				ChannelID:    old.ChannelID,
+				WebhookID:    old.WebhookID,
+				AttachmentID: old.AttachmentID,
+				DiscordURL:   old.DiscordURL,
+				UploadedAt:   record.UploadedAt,
+			},
+		}
+		h.records[filePath] = record
+	}
+
+	return nil
 }
 
 func (h *History) save() error {
@@ -0,0 +1,277 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Store keeps runtime state that has to survive restarts but doesn't
+// belong to a single uploaded file, like the threads created for uploads,
+// files waiting for review and the journal of uploads in flight.
+type Store struct {
+	stateFile string
+	data      stateData
+	mutex     sync.RWMutex
+	// saveMutex keeps saves in order, so an older snapshot never replaces
+	// a newer one.
+	saveMutex sync.Mutex
+}
+
+type stateData struct {
+	Threads   map[string]string   `json:"threads"`
+	Approvals map[string]Approval `json:"approvals"`
+	Uploads   map[string]Upload   `json:"pending_uploads"`
+}
+
+// Upload is written before a message is sent and removed once its files
+// are recorded in the history. An entry left behind means the process died
+// in between and the message may or may not have been posted. Unresolved
+// marks entries that couldn't be checked against the destination.
+type Upload struct {
+	Destination string    `json:"destination"`
+	Files       []string  `json:"files"`
+	ThreadID    string    `json:"thread_id,omitempty"`
+	NewThread   bool      `json:"new_thread,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	Unresolved  bool      `json:"unresolved,omitempty"`
+}
+
+type ApprovalStatus string
+
+const (
+	ApprovalPending  ApprovalStatus = "pending"
+	ApprovalApproved ApprovalStatus = "approved"
+	ApprovalRejected ApprovalStatus = "rejected"
+)
+
+// Approval tracks a file posted for review before it may be published to
+// a destination. Size and ModTime tie the decision to the reviewed version
+// of the file.
+type Approval struct {
+	Destination string         `json:"destination"`
+	FilePath    string         `json:"file_path"`
+	FileSize    int64          `json:"file_size"`
+	ModTime     time.Time      `json:"mod_time"`
+	Status      ApprovalStatus `json:"status"`
+	SubmittedAt time.Time      `json:"submitted_at"`
+}
+
+func New(stateFile string) (*Store, error) {
+	s := &Store{
+		stateFile: stateFile,
+		data: stateData{
+			Threads:   make(map[string]string),
+			Approvals: make(map[string]Approval),
+			Uploads:   make(map[string]Upload),
+		},
+	}
+
+	err := s.load()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to load state: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *Store) GetThread(destination, key string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	threadID, exists := s.data.Threads[threadKey(destination, key)]
+	return threadID, exists
+}
+
+func (s *Store) SetThread(destination, key, threadID string) error {
+	s.mutex.Lock()
+	s.data.Threads[threadKey(destination, key)] = threadID
+	s.mutex.Unlock()
+
+	return s.save()
+}
+
+func (s *Store) RemoveThread(destination, key string) error {
+	s.mutex.Lock()
+	delete(s.data.Threads, threadKey(destination, key))
+	s.mutex.Unlock()
+
+	return s.save()
+}
+
+// FindApproval returns the review of filePath for destination, keyed by
+// the ID of the review message.
+func (s *Store) FindApproval(destination, filePath string) (string, Approval, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for reviewID, approval := range s.data.Approvals {
+		if approval.Destination == destination && approval.FilePath == filePath {
+			return reviewID, approval, true
+		}
+	}
+	return "", Approval{}, false
+}
+
+func (s *Store) GetApproval(reviewID string) (Approval, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	approval, exists := s.data.Approvals[reviewID]
+	return approval, exists
+}
+
+func (s *Store) SetApproval(reviewID string, approval Approval) error {
+	s.mutex.Lock()
+	s.data.Approvals[reviewID] = approval
+	s.mutex.Unlock()
+
+	return s.save()
+}
+
+func (s *Store) RemoveApproval(reviewID string) error {
+	s.mutex.Lock()
+	delete(s.data.Approvals, reviewID)
+	s.mutex.Unlock()
+
+	return s.save()
+}
+
+func (s *Store) Approvals() map[string]Approval {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	approvals := make(map[string]Approval, len(s.data.Approvals))
+	for reviewID, approval := range s.data.Approvals {
+		approvals[reviewID] = approval
+	}
+	return approvals
+}
+
+// BeginUpload journals an upload under its nonce before it is sent.
+func (s *Store) BeginUpload(nonce string, upload Upload) error {
+	s.mutex.Lock()
+	s.data.Uploads[nonce] = upload
+	s.mutex.Unlock()
+
+	return s.save()
+}
+
+func (s *Store) FinishUpload(nonce string) error {
+	s.mutex.Lock()
+	delete(s.data.Uploads, nonce)
+	s.mutex.Unlock()
+
+	return s.save()
+}
+
+func (s *Store) MarkUploadUnresolved(nonce string) error {
+	s.mutex.Lock()
+	upload, exists := s.data.Uploads[nonce]
+	if exists {
+		upload.Unresolved = true
+		s.data.Uploads[nonce] = upload
+	}
+	s.mutex.Unlock()
+
+	if !exists {
+		return nil
+	}
+	return s.save()
+}
+
+// PendingUploads returns the uploads that were never finished.
+func (s *Store) PendingUploads() map[string]Upload {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	uploads := make(map[string]Upload, len(s.data.Uploads))
+	for nonce, upload := range s.data.Uploads {
+		uploads[nonce] = upload
+	}
+	return uploads
+}
+
+func threadKey(destination, key string) string {
+	return destination + "/" + key
+}
+
+func (s *Store) load() error {
+	data, err := os.ReadFile(s.stateFile)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, &s.data)
+	if err != nil {
+		return err
+	}
+
+	if s.data.Threads == nil {
+		s.data.Threads = make(map[string]string)
+	}
+
+	if s.data.Approvals == nil {
+		s.data.Approvals = make(map[string]Approval)
+	}
+
+	if s.data.Uploads == nil {
+		s.data.Uploads = make(map[string]Upload)
+	}
+
+	return nil
+}
+
+func (s *Store) save() error {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+
+	dir := filepath.Dir(s.stateFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	s.mutex.RLock()
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	s.mutex.RUnlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	return writeFileAtomic(s.stateFile, data)
+}
+
+// writeFileAtomic replaces path with data through a synced temporary file,
+// so a crash leaves either the old or the new state behind, never a torn
+// one.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+
+	return nil
+}
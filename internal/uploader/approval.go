@@ -0,0 +1,181 @@
+package uploader
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"discord-image-uploader/internal/destination"
+	"discord-image-uploader/internal/state"
+)
+
+// Destinations with a reviewer only get files that were approved in the
+// review channel. Reviews are kept in the state store, so a restart
+// neither loses them nor publishes a file nobody has looked at.
+
+// startReviews listens for decisions and catches up on the ones made while
+// the uploader wasn't running.
+func (u *Uploader) startReviews() {
+	for _, reviewer := range u.reviewers {
+		reviewer.OnDecision(u.handleDecision)
+	}
+
+	for reviewID, approval := range u.state.Approvals() {
+		reviewer, exists := u.reviewers[approval.Destination]
+		if !exists {
+			u.removeApproval(reviewID)
+			continue
+		}
+
+		if approval.Status == state.ApprovalRejected {
+			if _, err := os.Stat(approval.FilePath); os.IsNotExist(err) {
+				u.removeApproval(reviewID)
+			}
+			continue
+		}
+
+		if approval.Status != state.ApprovalPending {
+			continue
+		}
+
+		decision, err := reviewer.Decision(u.ctx, reviewID)
+		if errors.Is(err, destination.ErrMessageNotFound) {
+			log.Printf("Review message of %s is gone, submitting it again", approval.FilePath)
+			u.removeApproval(reviewID)
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: failed to check review of %s: %v", approval.FilePath, err)
+			continue
+		}
+
+		if decision != destination.DecisionPending {
+			u.handleDecision(reviewID, decision)
+		}
+	}
+}
+
+// submitForReview posts files pending for dest to its review channel and
+// holds them back until they are approved.
+func (u *Uploader) submitForReview(dest destination.Destination) {
+	reviewer, exists := u.reviewers[dest.Name()]
+	if !exists {
+		return
+	}
+
+	submitted := 0
+	for _, item := range u.queue {
+		if !item.isPendingFor(dest.Name()) {
+			continue
+		}
+
+		stat, err := os.Stat(item.path)
+		if err != nil {
+			continue
+		}
+
+		reviewID, approval, exists := u.state.FindApproval(dest.Name(), item.path)
+		if exists && (approval.FileSize != stat.Size() || !approval.ModTime.Equal(stat.ModTime())) {
+			log.Printf("%s changed after it was submitted for review", item.path)
+			u.removeApproval(reviewID)
+			exists = false
+		}
+
+		if exists {
+			switch approval.Status {
+			case state.ApprovalApproved:
+				delete(item.inReview, dest.Name())
+			case state.ApprovalRejected:
+				u.rejectFile(item, dest, "rejected in review")
+			default:
+				item.holdForReview(dest.Name())
+			}
+			continue
+		}
+
+		item.holdForReview(dest.Name())
+
+		// Don't flood the review channel, the rest follows with the next
+		// ticks.
+		if submitted >= u.config.Upload.BatchSize {
+			continue
+		}
+
+		message := destination.Message{Content: u.renderContent(dest, []*queuedFile{item})}
+		reviewID, err = reviewer.Submit(u.ctx, item.path, message)
+		if err != nil && u.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to submit %s for review: %v", item.path, err)
+			u.recordError("review of %s for %s failed: %v", item.path, dest.Name(), err)
+			continue
+		}
+		submitted++
+
+		err = u.state.SetApproval(reviewID, state.Approval{
+			Destination: dest.Name(),
+			FilePath:    item.path,
+			FileSize:    stat.Size(),
+			ModTime:     stat.ModTime(),
+			Status:      state.ApprovalPending,
+			SubmittedAt: time.Now(),
+		})
+		if err != nil {
+			log.Printf("Warning: failed to save review of %s: %v", item.path, err)
+		}
+
+		log.Printf("Submitted %s for review before publishing to %s", item.path, dest.Name())
+	}
+}
+
+// handleDecision only records the decision. The queue picks it up with the
+// next tick, so this never waits for a running batch.
+func (u *Uploader) handleDecision(reviewID string, decision destination.Decision) {
+	approval, exists := u.state.GetApproval(reviewID)
+	if !exists || approval.Status != state.ApprovalPending {
+		return
+	}
+
+	switch decision {
+	case destination.DecisionApproved:
+		approval.Status = state.ApprovalApproved
+		log.Printf("%s was approved for %s", approval.FilePath, approval.Destination)
+	case destination.DecisionRejected:
+		approval.Status = state.ApprovalRejected
+		log.Printf("%s was rejected for %s", approval.FilePath, approval.Destination)
+	default:
+		return
+	}
+
+	err := u.state.SetApproval(reviewID, approval)
+	if err != nil {
+		log.Printf("Warning: failed to save review decision for %s: %v", approval.FilePath, err)
+	}
+}
+
+// finishReview drops the review of a file once it has been published.
+func (u *Uploader) finishReview(dest destination.Destination, item *queuedFile) {
+	if _, exists := u.reviewers[dest.Name()]; !exists {
+		return
+	}
+
+	if reviewID, _, exists := u.state.FindApproval(dest.Name(), item.path); exists {
+		u.removeApproval(reviewID)
+	}
+}
+
+func (u *Uploader) removeApproval(reviewID string) {
+	err := u.state.RemoveApproval(reviewID)
+	if err != nil {
+		log.Printf("Warning: failed to remove review %s: %v", reviewID, err)
+	}
+}
+
+func (q *queuedFile) holdForReview(name string) {
+	if q.inReview == nil {
+		q.inReview = make(map[string]bool)
+	}
+	q.inReview[name] = true
+}
@@ -0,0 +1,94 @@
+package uploader
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"discord-image-uploader/internal/caption"
+	"discord-image-uploader/internal/config"
+	"discord-image-uploader/internal/destination"
+)
+
+// compileCaptions parses the global message template (keyed by a nil rule)
+// and the per-rule overrides. Templates were validated when loading the
+// config, so parse errors can't happen here.
+func compileCaptions(cfg *config.Config) map[*config.RuleConfig]*caption.Template {
+	captions := make(map[*config.RuleConfig]*caption.Template)
+
+	captions[nil], _ = caption.New(cfg.Discord.MessageTemplate)
+
+	for i := range cfg.Routing.Rules {
+		rule := &cfg.Routing.Rules[i]
+		if rule.MessageTemplate != "" {
+			captions[rule], _ = caption.New(rule.MessageTemplate)
+		}
+	}
+
+	return captions
+}
+
+// compileFolderCaptions parses the templates of watched folders, keyed by
+// folder path.
+func compileFolderCaptions(cfg *config.Config) map[string]*caption.Template {
+	captions := make(map[string]*caption.Template)
+
+	for _, folder := range cfg.Watcher.Folders {
+		if folder.MessageTemplate != "" {
+			captions[folder.Path], _ = caption.New(folder.MessageTemplate)
+		}
+	}
+
+	return captions
+}
+
+// captionFor picks the template of the file's rule, then the one of its
+// folder and finally the global one.
+func (u *Uploader) captionFor(item *queuedFile) *caption.Template {
+	if tmpl, exists := u.captions[item.rule]; exists && item.rule != nil {
+		return tmpl
+	}
+	if tmpl, exists := u.folderCaptions[u.watcher.RootPath(item.path)]; exists {
+		return tmpl
+	}
+	return u.captions[nil]
+}
+
+func (u *Uploader) renderContent(dest destination.Destination, batch []*queuedFile) string {
+	now := time.Now()
+	lines := make([]string, 0, len(batch))
+
+	for i, item := range batch {
+		relPath := u.watcher.RelPath(item.path)
+		folder := filepath.Dir(relPath)
+		if folder == "." {
+			folder = ""
+		}
+
+		data := caption.Data{
+			FileName:    filepath.Base(item.path),
+			RelPath:     filepath.ToSlash(relPath),
+			Folder:      filepath.ToSlash(folder),
+			Hostname:    u.hostname,
+			Index:       i + 1,
+			Count:       len(batch),
+			UploadTime:  now,
+			Destination: dest.Name(),
+		}
+
+		if stat, err := os.Stat(item.path); err == nil {
+			data.Size = stat.Size()
+			data.ModTime = stat.ModTime()
+		}
+
+		line, err := u.captionFor(item).Render(data)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return caption.Join(lines)
+}
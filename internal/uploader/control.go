@@ -0,0 +1,121 @@
+package uploader
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"discord-image-uploader/internal/control"
+)
+
+var _ control.Controller = (*Uploader)(nil)
+
+func (u *Uploader) Status() control.Status {
+	u.queueMutex.RLock()
+	status := control.Status{
+		QueueLength: len(u.queue),
+		FailedFiles: len(u.rejected),
+		RateLimited: make(map[string]time.Time),
+	}
+	for _, item := range u.queue {
+		if len(item.attempts) > 0 {
+			status.FailedFiles++
+		}
+	}
+	for _, files := range u.unresolvedUploads() {
+		status.UnresolvedFiles += len(files)
+	}
+	for name, retryAt := range u.retryAt {
+		if time.Now().Before(retryAt) {
+			status.RateLimited[name] = retryAt
+		}
+	}
+	u.queueMutex.RUnlock()
+
+	u.statusMutex.Lock()
+	status.Paused = u.paused
+	status.LastUpload = u.lastUpload
+	status.LastError = u.lastError
+	status.LastErrorAt = u.lastErrorAt
+	u.statusMutex.Unlock()
+
+	return status
+}
+
+func (u *Uploader) Pause() {
+	u.statusMutex.Lock()
+	u.paused = true
+	u.statusMutex.Unlock()
+
+	log.Println("Uploads paused")
+}
+
+func (u *Uploader) Resume() {
+	u.statusMutex.Lock()
+	u.paused = false
+	u.statusMutex.Unlock()
+
+	log.Println("Uploads resumed")
+}
+
+func (u *Uploader) isPaused() bool {
+	u.statusMutex.Lock()
+	defer u.statusMutex.Unlock()
+	return u.paused
+}
+
+// Flush runs batches until the queue stops shrinking, so files held back
+// by rate limits or failures don't keep it busy forever.
+func (u *Uploader) Flush() {
+	log.Println("Flushing upload queue...")
+
+	for {
+		before := u.GetQueueLength()
+		if before == 0 {
+			return
+		}
+
+		u.uploadBatch()
+
+		if u.GetQueueLength() >= before {
+			return
+		}
+	}
+}
+
+func (u *Uploader) Retry() int {
+	files := u.releaseUnresolved()
+
+	u.queueMutex.Lock()
+	for file := range u.rejected {
+		files = append(files, file)
+	}
+	u.rejected = make(map[string]rejection)
+
+	count := len(files)
+	for _, item := range u.queue {
+		if len(item.attempts) > 0 {
+			item.attempts = nil
+			count++
+		}
+	}
+	u.queueMutex.Unlock()
+
+	u.addToQueue(files...)
+
+	log.Printf("Retrying %d failed files", count)
+	return count
+}
+
+func (u *Uploader) recordUpload() {
+	u.statusMutex.Lock()
+	u.lastUpload = time.Now()
+	u.statusMutex.Unlock()
+}
+
+func (u *Uploader) recordError(format string, args ...interface{}) {
+	u.statusMutex.Lock()
+	u.lastError = fmt.Sprintf(format, args...)
+	u.lastErrorAt = time.Now()
+	u.statusMutex.Unlock()
+}
@@ -0,0 +1,180 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"time"
+
+	"discord-image-uploader/internal/destination"
+	"discord-image-uploader/internal/history"
+	"discord-image-uploader/internal/state"
+)
+
+// Discord accepts nonces of up to 25 characters.
+const maxNonceLength = 25
+
+// uploadNonce is derived from the destination and the content of the
+// files, so the same batch always gets the same nonce.
+func uploadNonce(dest string, batch []*queuedFile) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00", dest)
+
+	for _, item := range batch {
+		fileHash, err := history.HashFile(item.path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\x00", fileHash)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil))[:maxNonceLength], nil
+}
+
+// beginUpload writes the journal entry for a batch and returns its nonce,
+// or "" if the batch couldn't be journaled. The entry is only removed once
+// the result is recorded in the history. After a crash, or a shutdown that
+// cancelled a send that may have gone out, leftover entries are reconciled
+// against what the destination actually has, so a file is posted at most
+// once.
+func (u *Uploader) beginUpload(dest destination.Destination, batch []*queuedFile, message destination.Message) string {
+	nonce, err := uploadNonce(dest.Name(), batch)
+	if err != nil {
+		log.Printf("Warning: failed to derive upload nonce: %v", err)
+		return ""
+	}
+
+	files := make([]string, len(batch))
+	for i, item := range batch {
+		files[i] = item.path
+	}
+
+	err = u.state.BeginUpload(nonce, state.Upload{
+		Destination: dest.Name(),
+		Files:       files,
+		ThreadID:    message.ThreadID,
+		NewThread:   message.ThreadName != "",
+		StartedAt:   time.Now(),
+	})
+	if err != nil {
+		log.Printf("Warning: failed to journal upload: %v", err)
+	}
+
+	return nonce
+}
+
+func (u *Uploader) finishUpload(nonce string) {
+	if nonce == "" {
+		return
+	}
+
+	err := u.state.FinishUpload(nonce)
+	if err != nil {
+		log.Printf("Warning: failed to clear upload journal: %v", err)
+	}
+}
+
+// reconcileUploads settles uploads interrupted by a crash. Files found on
+// the destination are recorded as delivered. If that can't be checked, the
+// entry is kept as unresolved and its files are held back, since posting
+// them twice is worse than waiting for someone to look.
+func (u *Uploader) reconcileUploads() {
+	for nonce, upload := range u.state.PendingUploads() {
+		dest := u.destinationByName(upload.Destination)
+		if dest == nil {
+			u.finishUpload(nonce)
+			continue
+		}
+
+		log.Printf("Checking interrupted upload of %d files to %s", len(upload.Files), dest.Name())
+
+		result, err := u.findUpload(dest, upload)
+		switch {
+		case err != nil:
+			log.Printf("Warning: can't tell whether %v reached %s, holding them back until resolved: %v", upload.Files, dest.Name(), err)
+			u.recordError("unresolved upload of %d files to %s", len(upload.Files), dest.Name())
+			if err := u.state.MarkUploadUnresolved(nonce); err != nil {
+				log.Printf("Warning: failed to update upload journal: %v", err)
+			}
+			continue
+		case result == nil:
+			log.Printf("Interrupted upload to %s was never posted, files will be uploaded again", dest.Name())
+		default:
+			log.Printf("Interrupted upload to %s was posted as message %s", dest.Name(), result.MessageID)
+			u.markInterrupted(dest, upload.Files, result)
+		}
+
+		u.finishUpload(nonce)
+	}
+}
+
+// unresolvedUploads returns the files of unresolved uploads by destination.
+func (u *Uploader) unresolvedUploads() map[string]map[string]bool {
+	unresolved := make(map[string]map[string]bool)
+	for _, upload := range u.state.PendingUploads() {
+		if !upload.Unresolved {
+			continue
+		}
+		if unresolved[upload.Destination] == nil {
+			unresolved[upload.Destination] = make(map[string]bool)
+		}
+		for _, file := range upload.Files {
+			unresolved[upload.Destination][file] = true
+		}
+	}
+	return unresolved
+}
+
+// releaseUnresolved drops the unresolved uploads from the journal, so their
+// files are posted again, and returns those files.
+func (u *Uploader) releaseUnresolved() []string {
+	var files []string
+	for nonce, upload := range u.state.PendingUploads() {
+		if upload.Unresolved {
+			files = append(files, upload.Files...)
+			u.finishUpload(nonce)
+		}
+	}
+	return files
+}
+
+func (u *Uploader) findUpload(dest destination.Destination, upload state.Upload) (*destination.Result, error) {
+	reconciler, ok := dest.(destination.Reconciler)
+	if !ok {
+		return nil, fmt.Errorf("%s can't look up posted messages", dest.Name())
+	}
+
+	if upload.NewThread {
+		return nil, fmt.Errorf("the upload went to a new thread that was never recorded")
+	}
+
+	// Allow for clock skew between us and Discord.
+	return reconciler.FindUpload(u.ctx, upload.ThreadID, upload.Files, upload.StartedAt.Add(-time.Minute))
+}
+
+func (u *Uploader) markInterrupted(dest destination.Destination, files []string, result *destination.Result) {
+	for _, file := range files {
+		fileResult, _ := result.File(file)
+
+		err := u.history.MarkDelivered(file, dest.Name(), history.Delivery{
+			MessageID:    result.MessageID,
+			ChannelID:    result.ChannelID,
+			WebhookID:    result.WebhookID,
+			ThreadID:     result.ThreadID,
+			AttachmentID: fileResult.Attachment.ID,
+			DiscordURL:   fileResult.Attachment.URL,
+		})
+		if err != nil {
+			log.Printf("Warning: failed to record %s as delivered: %v", file, err)
+		}
+	}
+}
+
+func (u *Uploader) destinationByName(name string) destination.Destination {
+	for _, dest := range u.destinations {
+		if dest.Name() == name {
+			return dest
+		}
+	}
+	return nil
+}
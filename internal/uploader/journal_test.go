@@ -0,0 +1,150 @@
+package uploader
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"discord-image-uploader/internal/discord"
+	"discord-image-uploader/internal/state"
+)
+
+// A send cancelled while it waits for the rate limit never reached Discord,
+// so its files have to be posted after a restart even though webhooks
+// can't be reconciled.
+func TestCancelledWebhookSendIsRetriedAfterRestart(t *testing.T) {
+	var mutex sync.Mutex
+	var posted []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var attachments []map[string]string
+		mutex.Lock()
+		for _, files := range r.MultipartForm.File {
+			for _, file := range files {
+				posted = append(posted, file.Filename)
+				attachments = append(attachments, map[string]string{
+					"id":       fmt.Sprintf("a%d", len(posted)),
+					"filename": file.Filename,
+				})
+			}
+		}
+		id := fmt.Sprintf("m%d", len(posted))
+		mutex.Unlock()
+
+		// Every answer uses up the bucket for the next three seconds.
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset-After", "3")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":          id,
+			"channel_id":  "c1",
+			"attachments": attachments,
+		})
+	}))
+	defer server.Close()
+
+	newWebhook := func() *discord.WebhookClient {
+		client, err := discord.NewWebhookClient(server.URL+"/api/webhooks/1/token", discord.Options{
+			Name:       "hook",
+			APIBaseURL: server.URL + "/api/",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	dir := t.TempDir()
+	files := writeImages(t, dir, "a.png", "b.png")
+
+	first := newTestUploader(t, dir, 1, newWebhook())
+	first.addToQueue(files...)
+	first.uploadBatch()
+
+	done := make(chan struct{})
+	go func() {
+		first.uploadBatch()
+		close(done)
+	}()
+
+	// Let the second batch run into the rate limit, then shut down.
+	time.Sleep(200 * time.Millisecond)
+	first.Stop()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("cancelled upload didn't return")
+	}
+
+	if pending := first.state.PendingUploads(); len(pending) != 0 {
+		t.Fatalf("journal kept %d uploads that were never sent", len(pending))
+	}
+
+	second := newTestUploader(t, dir, 1, newWebhook())
+	second.reconcileUploads()
+	second.addToQueue(files...)
+	second.uploadBatch()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(posted) != 2 || posted[0] != "a.png" || posted[1] != "b.png" {
+		t.Fatalf("posted %v, want [a.png b.png]", posted)
+	}
+
+	if _, delivered := second.history.GetDeliveries(files[1])["hook"]; !delivered {
+		t.Fatal("b.png isn't recorded as delivered")
+	}
+}
+
+// An interrupted upload that can't be checked must neither count as
+// delivered, which could get the file deleted, nor be posted again on its
+// own.
+func TestUnresolvedUploadIsHeldBackUntilRetry(t *testing.T) {
+	dir := t.TempDir()
+	files := writeImages(t, dir, "a.png", "b.png")
+
+	crashed := newTestUploader(t, dir, 5, &fakeDestination{name: "hook"})
+	err := crashed.state.BeginUpload("n1", state.Upload{Destination: "hook", Files: files[:1], StartedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for restart := 0; restart < 2; restart++ {
+		u := newTestUploader(t, dir, 5, &fakeDestination{name: "hook"})
+		u.reconcileUploads()
+		u.addToQueue(files...)
+
+		if u.isDelivered(files[0], "hook") {
+			t.Fatal("unchecked upload was recorded as delivered")
+		}
+		if u.GetQueueLength() != 1 || u.isQueued(files[0]) {
+			t.Fatalf("restart %d: a.png is queued again", restart)
+		}
+		if unresolved := u.Status().UnresolvedFiles; unresolved != 1 {
+			t.Fatalf("restart %d: status reports %d unresolved files", restart, unresolved)
+		}
+	}
+
+	dest := &fakeDestination{name: "hook"}
+	u := newTestUploader(t, dir, 5, dest)
+	u.reconcileUploads()
+	u.addToQueue(files...)
+	u.Retry()
+	u.uploadBatch()
+
+	if !u.isDelivered(files[0], "hook") || len(dest.sends) != 1 || len(dest.sends[0]) != 2 {
+		t.Errorf("sends after retry = %v, want a.png and b.png", dest.sends)
+	}
+	if pending := u.state.PendingUploads(); len(pending) != 0 {
+		t.Errorf("journal kept %d uploads after retry", len(pending))
+	}
+}
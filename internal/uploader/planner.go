@@ -0,0 +1,67 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+
+	"discord-image-uploader/internal/destination"
+)
+
+type batchPlan struct {
+	batch    []*queuedFile
+	rejected map[*queuedFile]string
+}
+
+// planBatch packs the pending files of the queue into one message for a
+// destination. Files are taken first-fit in queue order while both the
+// attachment count and the cumulative size stay within the destination's
+// limits. Files that could never fit into any message are rejected.
+func planBatch(queue []*queuedFile, name string, caps destination.Capabilities, batchSize int, accept func(first, item *queuedFile) bool) batchPlan {
+	plan := batchPlan{rejected: make(map[*queuedFile]string)}
+
+	maxFiles := batchSize
+	if caps.MaxAttachments > 0 && caps.MaxAttachments < maxFiles {
+		maxFiles = caps.MaxAttachments
+	}
+
+	var total int64
+	for _, item := range queue {
+		if !item.isReadyFor(name) {
+			continue
+		}
+
+		stat, err := os.Stat(item.path)
+		if err != nil {
+			plan.rejected[item] = fmt.Sprintf("cannot stat file: %v", err)
+			continue
+		}
+		size := stat.Size()
+
+		if caps.MaxFileBytes > 0 && size > caps.MaxFileBytes {
+			plan.rejected[item] = fmt.Sprintf("file is %d bytes, per-file limit is %d bytes", size, caps.MaxFileBytes)
+			continue
+		}
+
+		if caps.MaxBytes > 0 && size > caps.MaxBytes {
+			plan.rejected[item] = fmt.Sprintf("file is %d bytes, per-message limit is %d bytes", size, caps.MaxBytes)
+			continue
+		}
+
+		if len(plan.batch) >= maxFiles {
+			break
+		}
+
+		if caps.MaxBytes > 0 && total+size > caps.MaxBytes {
+			continue
+		}
+
+		if len(plan.batch) > 0 && !accept(plan.batch[0], item) {
+			continue
+		}
+
+		plan.batch = append(plan.batch, item)
+		total += size
+	}
+
+	return plan
+}
@@ -0,0 +1,115 @@
+package uploader
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"discord-image-uploader/internal/destination"
+	"discord-image-uploader/internal/history"
+)
+
+// queueOf queues one file per size for destination "hook".
+func queueOf(t *testing.T, sizes ...int) []*queuedFile {
+	t.Helper()
+
+	dir := t.TempDir()
+	var queue []*queuedFile
+	for i, size := range sizes {
+		file := filepath.Join(dir, string(rune('a'+i))+".png")
+		if err := os.WriteFile(file, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		queue = append(queue, &queuedFile{path: file, pending: []string{"hook"}})
+	}
+	return queue
+}
+
+func acceptAll(first, item *queuedFile) bool { return true }
+
+func TestPlanBatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		sizes     []int
+		caps      destination.Capabilities
+		batchSize int
+		batch     []int
+		rejected  []int
+	}{
+		{"batch size", []int{1, 1, 1}, destination.Capabilities{}, 2, []int{0, 1}, nil},
+		{"attachment limit", []int{1, 1, 1}, destination.Capabilities{MaxAttachments: 1}, 5, []int{0}, nil},
+		{"file too large", []int{5, 20, 5}, destination.Capabilities{MaxFileBytes: 10}, 5, []int{0, 2}, []int{1}},
+		{"larger than a message", []int{5, 20}, destination.Capabilities{MaxBytes: 10}, 5, []int{0}, []int{1}},
+		{"first fit", []int{6, 6, 3}, destination.Capabilities{MaxBytes: 10}, 5, []int{0, 2}, nil},
+		{"exact fit", []int{4, 6}, destination.Capabilities{MaxBytes: 10}, 5, []int{0, 1}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := queueOf(t, test.sizes...)
+			plan := planBatch(queue, "hook", test.caps, test.batchSize, acceptAll)
+
+			var batch []int
+			for _, item := range plan.batch {
+				batch = append(batch, indexOf(queue, item))
+			}
+			if !reflect.DeepEqual(batch, test.batch) {
+				t.Errorf("batch = %v, want %v", batch, test.batch)
+			}
+
+			if len(plan.rejected) != len(test.rejected) {
+				t.Fatalf("rejected %d files, want %v", len(plan.rejected), test.rejected)
+			}
+			for _, i := range test.rejected {
+				if _, rejected := plan.rejected[queue[i]]; !rejected {
+					t.Errorf("file %d wasn't rejected", i)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanBatchSkipsFilesNotReady(t *testing.T) {
+	queue := queueOf(t, 1, 1, 1, 1)
+	queue[0].pending = []string{"other"}
+	queue[1].inReview = map[string]bool{"hook": true}
+	queue[2].replaces = map[string]history.Delivery{"hook": {}}
+
+	plan := planBatch(queue, "hook", destination.Capabilities{}, 5, acceptAll)
+	if len(plan.batch) != 1 || plan.batch[0] != queue[3] {
+		t.Errorf("batch = %v, want only the last file", plan.batch)
+	}
+}
+
+func TestPlanBatchKeepsToAcceptedGroup(t *testing.T) {
+	queue := queueOf(t, 1, 1, 1)
+	// The second file belongs to another thread than the first.
+	sameThread := func(first, item *queuedFile) bool {
+		return item != queue[1]
+	}
+
+	plan := planBatch(queue, "hook", destination.Capabilities{}, 5, sameThread)
+	if !reflect.DeepEqual(plan.batch, []*queuedFile{queue[0], queue[2]}) {
+		t.Errorf("batch = %v, want the first and last file", plan.batch)
+	}
+}
+
+func TestPlanBatchRejectsMissingFiles(t *testing.T) {
+	queue := queueOf(t, 1)
+	os.Remove(queue[0].path)
+
+	plan := planBatch(queue, "hook", destination.Capabilities{}, 5, acceptAll)
+	if len(plan.batch) != 0 || len(plan.rejected) != 1 {
+		t.Errorf("plan = %+v, want the missing file rejected", plan)
+	}
+}
+
+func indexOf(queue []*queuedFile, item *queuedFile) int {
+	for i, queued := range queue {
+		if queued == item {
+			return i
+		}
+	}
+	return -1
+}
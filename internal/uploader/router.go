@@ -0,0 +1,94 @@
+package uploader
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"discord-image-uploader/internal/config"
+)
+
+type router struct {
+	rules    []config.RuleConfig
+	defaults []string
+}
+
+func newRouter(routing config.RoutingConfig, destinations []string) *router {
+	defaults := routing.DefaultDestinations
+	if len(defaults) == 0 {
+		defaults = destinations
+	}
+
+	return &router{
+		rules:    routing.Rules,
+		defaults: defaults,
+	}
+}
+
+// route returns the first rule matching the file together with the
+// destinations it is bound for. The rule is nil if the defaults apply;
+// folderDefaults, the destinations of the file's watched folder, take
+// precedence over the global ones.
+func (r *router) route(file, relPath string, folderDefaults []string) (*config.RuleConfig, []string) {
+	var size int64 = -1
+	if stat, err := os.Stat(file); err == nil {
+		size = stat.Size()
+	}
+
+	relPath = filepath.ToSlash(relPath)
+
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if ruleMatches(rule, relPath, size) {
+			return rule, rule.Destinations
+		}
+	}
+
+	if len(folderDefaults) > 0 {
+		return nil, folderDefaults
+	}
+	return nil, r.defaults
+}
+
+func ruleMatches(rule *config.RuleConfig, relPath string, size int64) bool {
+	if rule.Folder != "" {
+		folder := strings.Trim(filepath.ToSlash(rule.Folder), "/")
+		dir := path.Dir(relPath)
+		if dir != folder && !strings.HasPrefix(dir, folder+"/") {
+			return false
+		}
+	}
+
+	if rule.Pattern != "" {
+		matchedPath, _ := path.Match(rule.Pattern, relPath)
+		matchedName, _ := path.Match(rule.Pattern, path.Base(relPath))
+		if !matchedPath && !matchedName {
+			return false
+		}
+	}
+
+	if len(rule.Extensions) > 0 {
+		ext := strings.ToLower(path.Ext(relPath))
+		found := false
+		for _, ruleExt := range rule.Extensions {
+			if ext == ruleExt {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if rule.MinSizeMB > 0 && (size < 0 || float64(size) < rule.MinSizeMB*1024*1024) {
+		return false
+	}
+
+	if rule.MaxSizeMB > 0 && (size < 0 || float64(size) > rule.MaxSizeMB*1024*1024) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,43 @@
+package uploader
+
+import (
+	"testing"
+
+	"discord-image-uploader/internal/config"
+)
+
+func TestRuleMatches(t *testing.T) {
+	const mb = 1024 * 1024
+
+	tests := []struct {
+		name    string
+		rule    config.RuleConfig
+		relPath string
+		size    int64
+		want    bool
+	}{
+		{"empty rule", config.RuleConfig{}, "a/b.png", 1, true},
+		{"folder", config.RuleConfig{Folder: "screens"}, "screens/a.png", 1, true},
+		{"subfolder", config.RuleConfig{Folder: "screens"}, "screens/2024/a.png", 1, true},
+		{"other folder", config.RuleConfig{Folder: "screens"}, "screenshots/a.png", 1, false},
+		{"root file", config.RuleConfig{Folder: "screens"}, "a.png", 1, false},
+		{"folder with slashes", config.RuleConfig{Folder: "/screens/"}, "screens/a.png", 1, true},
+		{"pattern on name", config.RuleConfig{Pattern: "IMG_*"}, "phone/IMG_1.jpg", 1, true},
+		{"pattern on path", config.RuleConfig{Pattern: "phone/*.jpg"}, "phone/x.jpg", 1, true},
+		{"pattern misses", config.RuleConfig{Pattern: "IMG_*"}, "phone/DSC_1.jpg", 1, false},
+		{"extension", config.RuleConfig{Extensions: []string{".gif"}}, "a.GIF", 1, true},
+		{"other extension", config.RuleConfig{Extensions: []string{".gif"}}, "a.png", 1, false},
+		{"min size", config.RuleConfig{MinSizeMB: 1}, "a.png", 2 * mb, true},
+		{"below min size", config.RuleConfig{MinSizeMB: 1}, "a.png", mb / 2, false},
+		{"max size", config.RuleConfig{MaxSizeMB: 1}, "a.png", mb / 2, true},
+		{"above max size", config.RuleConfig{MaxSizeMB: 1}, "a.png", 2 * mb, false},
+		{"unknown size", config.RuleConfig{MaxSizeMB: 1}, "a.png", -1, false},
+		{"all conditions", config.RuleConfig{Folder: "screens", Pattern: "*.png", Extensions: []string{".png"}, MaxSizeMB: 1}, "screens/a.png", 1, true},
+	}
+
+	for _, test := range tests {
+		if got := ruleMatches(&test.rule, test.relPath, test.size); got != test.want {
+			t.Errorf("%s: ruleMatches(%q) = %v, want %v", test.name, test.relPath, got, test.want)
+		}
+	}
+}
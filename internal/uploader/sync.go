@@ -0,0 +1,168 @@
+package uploader
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"discord-image-uploader/internal/destination"
+	"discord-image-uploader/internal/history"
+)
+
+// In sync mode, files deleted locally are taken off the messages they were
+// posted in, and edited files replace their attachment in place instead of
+// being posted again.
+
+func (u *Uploader) editorFor(name string) (destination.Destination, destination.Editor, bool) {
+	dest := u.destinationByName(name)
+	if dest == nil {
+		return nil, nil, false
+	}
+
+	editor, ok := dest.(destination.Editor)
+	if !ok || !dest.Capabilities().CanEditMessages {
+		return nil, nil, false
+	}
+	return dest, editor, true
+}
+
+// editableDeliveries returns the deliveries of an older version of file
+// that can be updated in place for the pending destinations.
+func (u *Uploader) editableDeliveries(file string, pending []string) map[string]history.Delivery {
+	if !u.config.Sync.Enabled {
+		return nil
+	}
+
+	record, exists := u.history.GetRecord(file)
+	if !exists {
+		return nil
+	}
+
+	replaces := make(map[string]history.Delivery)
+	for _, name := range pending {
+		delivery, delivered := record.Deliveries[name]
+		if !delivered || delivery.MessageID == "" {
+			continue
+		}
+		// A new version has to pass the review again.
+		if _, reviewed := u.reviewers[name]; reviewed {
+			continue
+		}
+		if _, _, ok := u.editorFor(name); ok {
+			replaces[name] = delivery
+		}
+	}
+
+	if len(replaces) == 0 {
+		return nil
+	}
+	return replaces
+}
+
+// replaceFiles updates the messages of edited files queued for dest. Files
+// whose message is gone are left pending and get posted as new ones.
+func (u *Uploader) replaceFiles(dest destination.Destination) {
+	_, editor, ok := u.editorFor(dest.Name())
+	if !ok {
+		return
+	}
+
+	for _, item := range u.queue {
+		delivery, replacing := item.replaces[dest.Name()]
+		if !replacing || !item.isPendingFor(dest.Name()) {
+			continue
+		}
+
+		result, err := editor.ReplaceAttachment(u.ctx, messageRef(delivery), item.path)
+		if errors.Is(err, destination.ErrMessageNotFound) {
+			log.Printf("Message of %s on %s is gone, posting it again", item.path, dest.Name())
+			delete(item.replaces, dest.Name())
+			continue
+		}
+		if err != nil && u.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to update %s on %s: %v", item.path, dest.Name(), err)
+			u.handleRateLimit(dest, err)
+			u.handleFailedFile(dest, item, destination.FileResult{
+				Path:   item.path,
+				Status: destination.FileFailed,
+				Reason: err.Error(),
+			})
+			if time.Now().Before(u.retryAt[dest.Name()]) {
+				return
+			}
+			continue
+		}
+
+		file, _ := result.File(item.path)
+		if file.Status != destination.FileSent {
+			u.handleFailedFile(dest, item, file)
+			continue
+		}
+
+		delete(item.replaces, dest.Name())
+		u.handleSuccessfulUpload(dest, item, result, file)
+	}
+}
+
+// handleRemovedFile mirrors the local deletion of file to every
+// destination it was delivered to. The queue is only locked to drop the
+// file, so uploads go on while Discord is being updated.
+func (u *Uploader) handleRemovedFile(file string) {
+	u.queueMutex.Lock()
+	remaining := u.queue[:0]
+	for _, item := range u.queue {
+		if item.path != file {
+			remaining = append(remaining, item)
+		}
+	}
+	u.queue = remaining
+	delete(u.rejected, file)
+	record, exists := u.history.GetRecord(file)
+	u.queueMutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	for name, delivery := range record.Deliveries {
+		dest, editor, ok := u.editorFor(name)
+		if !ok || delivery.MessageID == "" {
+			continue
+		}
+
+		err := editor.RemoveAttachment(u.ctx, messageRef(delivery), file)
+		if err != nil && !errors.Is(err, destination.ErrMessageNotFound) {
+			log.Printf("Failed to remove %s from %s: %v", file, name, err)
+			u.queueMutex.Lock()
+			u.handleRateLimit(dest, err)
+			u.queueMutex.Unlock()
+			continue
+		}
+
+		err = u.history.RemoveDelivery(file, name)
+		if err != nil {
+			log.Printf("Warning: failed to update history for %s: %v", file, err)
+		}
+	}
+}
+
+// syncRemovedFiles catches up on files that were deleted while the
+// uploader wasn't running.
+func (u *Uploader) syncRemovedFiles() {
+	for _, file := range u.history.MissingFiles() {
+		log.Printf("Uploaded file %s is gone, removing it from Discord", file)
+		u.handleRemovedFile(file)
+	}
+}
+
+func messageRef(delivery history.Delivery) destination.MessageRef {
+	return destination.MessageRef{
+		MessageID:    delivery.MessageID,
+		ChannelID:    delivery.ChannelID,
+		ThreadID:     delivery.ThreadID,
+		AttachmentID: delivery.AttachmentID,
+	}
+}
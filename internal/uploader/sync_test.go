@@ -0,0 +1,66 @@
+package uploader
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"discord-image-uploader/internal/destination"
+	"discord-image-uploader/internal/history"
+)
+
+// fakeEditor is a fakeDestination that can edit its messages. remove
+// decides the outcome of RemoveAttachment.
+type fakeEditor struct {
+	*fakeDestination
+	remove func(filePath string) error
+}
+
+func (f *fakeEditor) RemoveAttachment(ctx context.Context, ref destination.MessageRef, filePath string) error {
+	return f.remove(filePath)
+}
+
+func (f *fakeEditor) ReplaceAttachment(ctx context.Context, ref destination.MessageRef, filePath string) (*destination.Result, error) {
+	return sentResult([]string{filePath}, nil), nil
+}
+
+func TestRemovedFileIsTakenOffDiscordWithoutLockingTheQueue(t *testing.T) {
+	dir := t.TempDir()
+	files := writeImages(t, dir, "a.png", "b.png")
+	dest := &fakeEditor{fakeDestination: &fakeDestination{
+		name: "bot",
+		caps: destination.Capabilities{CanEditMessages: true},
+	}}
+
+	u := newTestUploader(t, dir, 5, dest)
+	if err := u.history.MarkDelivered(files[0], "bot", history.Delivery{MessageID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	u.addToQueue(files...)
+
+	var removed []string
+	dest.remove = func(filePath string) error {
+		if !u.queueMutex.TryLock() {
+			t.Error("queue is locked while Discord is called")
+		} else {
+			u.queueMutex.Unlock()
+		}
+		removed = append(removed, filePath)
+		return nil
+	}
+
+	if err := os.Remove(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	u.handleRemovedFile(files[0])
+
+	if len(removed) != 1 || removed[0] != files[0] {
+		t.Errorf("removed %v, want %s", removed, files[0])
+	}
+	if u.isDelivered(files[0], "bot") {
+		t.Error("delivery of the removed file is still recorded")
+	}
+	if u.GetQueueLength() != 1 {
+		t.Errorf("queue length = %d, want only the remaining file", u.GetQueueLength())
+	}
+}
@@ -0,0 +1,104 @@
+package uploader
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"time"
+
+	"discord-image-uploader/internal/config"
+	"discord-image-uploader/internal/destination"
+)
+
+// threadKey returns the key identifying the thread a file belongs to under
+// the destination's thread strategy, or "" if no thread has to be created.
+func (u *Uploader) threadKey(thread config.ThreadConfig, item *queuedFile) string {
+	switch thread.Strategy {
+	case "daily":
+		return time.Now().Format("2006-01-02")
+	case "folder":
+		folder := filepath.ToSlash(filepath.Dir(u.watcher.RelPath(item.path)))
+		if folder == "." {
+			return "/"
+		}
+		return folder
+	case "session":
+		return u.sessionStart.Format("2006-01-02 15:04:05")
+	default:
+		return ""
+	}
+}
+
+func threadName(thread config.ThreadConfig, key string) string {
+	name := key
+	if thread.Strategy == "session" {
+		name = "Session " + key
+	}
+	if thread.NamePrefix != "" {
+		name = thread.NamePrefix + " " + name
+	}
+
+	// Discord limits channel names to 100 characters.
+	if runes := []rune(name); len(runes) > 100 {
+		name = string(runes[:100])
+	}
+	return name
+}
+
+// applyThread fills in where the message for batch has to be posted: the
+// fixed thread, a thread created earlier for the same key, or a new one.
+func (u *Uploader) applyThread(dest destination.Destination, batch []*queuedFile, message *destination.Message) string {
+	thread := u.destinationConfigs[dest.Name()].Thread
+
+	if thread.Strategy == "fixed" {
+		message.ThreadID = thread.ID
+		return ""
+	}
+
+	key := u.threadKey(thread, batch[0])
+	if key == "" {
+		return ""
+	}
+
+	if threadID, exists := u.state.GetThread(dest.Name(), key); exists {
+		message.ThreadID = threadID
+	} else {
+		message.ThreadName = threadName(thread, key)
+	}
+
+	return key
+}
+
+func (u *Uploader) rememberThread(dest destination.Destination, key string, message destination.Message, result *destination.Result) {
+	if key == "" || message.ThreadName == "" || result.ChannelID == "" {
+		return
+	}
+
+	err := u.state.SetThread(dest.Name(), key, result.ChannelID)
+	if err != nil {
+		log.Printf("Warning: failed to remember thread for %s: %v", dest.Name(), err)
+	}
+}
+
+// forgetThread drops a cached thread that Discord no longer knows, so the
+// next attempt creates a fresh one.
+func (u *Uploader) forgetThread(dest destination.Destination, key string, err error) {
+	if key == "" || !errors.Is(err, destination.ErrThreadNotFound) {
+		return
+	}
+
+	log.Printf("Thread for %s (%s) no longer exists, a new one will be created", dest.Name(), key)
+	if err := u.state.RemoveThread(dest.Name(), key); err != nil {
+		log.Printf("Warning: failed to forget thread for %s: %v", dest.Name(), err)
+	}
+}
+
+// sameThread reports whether item ends up in the same thread as first, so
+// per-folder threads never receive files from other folders.
+func (u *Uploader) sameThread(dest destination.Destination, first, item *queuedFile) bool {
+	thread := u.destinationConfigs[dest.Name()].Thread
+	if thread.Strategy != "folder" {
+		return true
+	}
+	return u.threadKey(thread, first) == u.threadKey(thread, item)
+}
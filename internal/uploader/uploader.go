@@ -1,43 +1,111 @@
 package uploader
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"sync"
 	"time"
 
+	"discord-image-uploader/internal/caption"
 	"discord-image-uploader/internal/config"
-	"discord-image-uploader/internal/discord"
+	"discord-image-uploader/internal/destination"
 	"discord-image-uploader/internal/history"
+	"discord-image-uploader/internal/state"
 	"discord-image-uploader/internal/watcher"
 )
 
 type Uploader struct {
-	config        *config.Config
-	discordClient *discord.Client
-	watcher       *watcher.Watcher
-	history       *history.History
-	queue         []string
-	queueMutex    sync.RWMutex
-	ticker        *time.Ticker
-	doneChan      chan bool
+	config             *config.Config
+	destinations       []destination.Destination
+	reviewers          map[string]destination.Reviewer
+	destinationConfigs map[string]config.DestinationConfig
+	watcher            *watcher.Watcher
+	history            *history.History
+	state              *state.Store
+	router             *router
+	captions           map[*config.RuleConfig]*caption.Template
+	folderCaptions     map[string]*caption.Template
+	folders            map[string]config.FolderConfig
+	hostname           string
+	sessionStart       time.Time
+	queue              []*queuedFile
+	queueMutex         sync.RWMutex
+	ticker             *time.Ticker
+	doneChan           chan bool
+	ctx                context.Context
+	cancel             context.CancelFunc
+	retryAt            map[string]time.Time
+	rejected           map[string]rejection
+	statusMutex        sync.Mutex
+	paused             bool
+	lastUpload         time.Time
+	lastError          string
+	lastErrorAt        time.Time
 }
 
-func New(cfg *config.Config, discordClient *discord.Client, watcher *watcher.Watcher, history *history.History) *Uploader {
-	return &Uploader{
-		config:        cfg,
-		discordClient: discordClient,
-		watcher:       watcher,
-		history:       history,
-		queue:         make([]string, 0),
-		doneChan:      make(chan bool),
+// A file that a destination skipped or dropped this many times in a row is
+// rejected there instead of being retried forever.
+const maxFileAttempts = 3
+
+type queuedFile struct {
+	path     string
+	rule     *config.RuleConfig
+	pending  []string
+	attempts map[string]int
+	replaces map[string]history.Delivery
+	inReview map[string]bool
+	rejected bool
+}
+
+type rejection struct {
+	destination string
+	reason      string
+	size        int64
+	modTime     time.Time
+}
+
+// New creates the uploader. reviewers maps destination names to the
+// reviewer their files have to pass first; it may be nil.
+func New(cfg *config.Config, destinations []destination.Destination, reviewers map[string]destination.Reviewer, watcher *watcher.Watcher, history *history.History, state *state.Store) *Uploader {
+	u := &Uploader{
+		config:             cfg,
+		destinations:       destinations,
+		reviewers:          reviewers,
+		destinationConfigs: make(map[string]config.DestinationConfig),
+		watcher:            watcher,
+		history:            history,
+		state:              state,
+		sessionStart:       time.Now(),
+		queue:              make([]*queuedFile, 0),
+		doneChan:           make(chan bool),
+		retryAt:            make(map[string]time.Time),
+		rejected:           make(map[string]rejection),
+	}
+	u.ctx, u.cancel = context.WithCancel(context.Background())
+	for _, destCfg := range cfg.Discord.Destinations {
+		u.destinationConfigs[destCfg.Name] = destCfg
 	}
+	u.router = newRouter(cfg.Routing, u.destinationNames())
+	u.captions = compileCaptions(cfg)
+	u.folderCaptions = compileFolderCaptions(cfg)
+	u.folders = make(map[string]config.FolderConfig)
+	for _, folder := range cfg.Watcher.Folders {
+		u.folders[folder.Path] = folder
+	}
+	u.hostname = caption.Hostname()
+	return u
 }
 
 func (u *Uploader) Start() error {
 	log.Println("Starting uploader...")
 
+	if u.config.Sync.Enabled {
+		u.syncRemovedFiles()
+	}
+
 	if u.config.History.CleanupMissingFiles {
 		err := u.history.CleanupMissingFiles()
 		if err != nil {
@@ -45,6 +113,9 @@ func (u *Uploader) Start() error {
 		}
 	}
 
+	u.reconcileUploads()
+	u.startReviews()
+
 	existingFiles, err := u.watcher.ScanExistingFiles()
 	if err != nil {
 		return fmt.Errorf("failed to scan existing files: %w", err)
@@ -69,21 +140,66 @@ func (u *Uploader) Stop() {
 
 	close(u.doneChan)
 
-	u.processRemainingQueue()
+	// Running requests are aborted instead of waited for. Their files stay
+	// in the queue and are picked up again by the next start.
+	u.cancel()
+
+	u.queueMutex.RLock()
+	queueLength := len(u.queue)
+	u.queueMutex.RUnlock()
+
+	if queueLength > 0 {
+		log.Printf("Leaving %d files in queue for the next start", queueLength)
+	}
 }
 
 func (u *Uploader) addToQueue(files ...string) {
 	u.queueMutex.Lock()
 	defer u.queueMutex.Unlock()
 
+	unresolved := u.unresolvedUploads()
+
 	var newFiles []string
 	for _, file := range files {
-		if u.isValidFile(file) && !u.history.IsUploaded(file) {
-			u.queue = append(u.queue, file)
-			newFiles = append(newFiles, file)
-		} else if u.history.IsUploaded(file) {
+		if u.isQueued(file) || u.isRejected(file) {
+			continue
+		}
+
+		folder := u.folders[u.watcher.RootPath(file)]
+		rule, targets := u.router.route(file, u.watcher.RelPath(file), folder.Destinations)
+		if !u.isValidFile(file, targets) {
+			continue
+		}
+
+		deliveries := u.history.GetDeliveries(file)
+		var pending []string
+		for _, target := range targets {
+			if _, delivered := deliveries[target]; delivered {
+				continue
+			}
+			if unresolved[target][file] {
+				log.Printf("Holding back %s for %s until its interrupted upload is resolved", file, target)
+				continue
+			}
+			pending = append(pending, target)
+		}
+
+		if len(pending) == 0 {
 			log.Printf("Skipping already uploaded file: %s", file)
+			continue
+		}
+
+		if rule != nil {
+			log.Printf("Routing %s via %s to %v", file, rule.Name, pending)
 		}
+
+		item := &queuedFile{path: file, rule: rule, pending: pending}
+		if deliveries == nil {
+			item.replaces = u.editableDeliveries(file, pending)
+		}
+
+		u.queue = append(u.queue, item)
+		newFiles = append(newFiles, file)
 	}
 
 	if len(newFiles) > 0 {
@@ -95,24 +211,15 @@ func (u *Uploader) processQueue() {
 	for {
 		select {
 		case <-u.ticker.C:
-			u.uploadBatch()
+			if !u.isPaused() {
+				u.uploadBatch()
+			}
 		case <-u.doneChan:
 			return
 		}
 	}
 }
 
-func (u *Uploader) processRemainingQueue() {
-	u.queueMutex.RLock()
-	queueLength := len(u.queue)
-	u.queueMutex.RUnlock()
-
-	if queueLength > 0 {
-		log.Printf("Processing remaining %d files in queue...", queueLength)
-		u.uploadBatch()
-	}
-}
-
 func (u *Uploader) uploadBatch() {
 	u.queueMutex.Lock()
 	defer u.queueMutex.Unlock()
@@ -121,40 +228,189 @@ func (u *Uploader) uploadBatch() {
 		return
 	}
 
-	batchSize := u.config.Upload.BatchSize
-	if batchSize > len(u.queue) {
-		batchSize = len(u.queue)
+	// Every destination gets at most one batch per tick, and a batch only
+	// contains files that were routed to that destination.
+	for _, dest := range u.destinations {
+		if u.ctx.Err() != nil {
+			break
+		}
+
+		if time.Now().Before(u.retryAt[dest.Name()]) {
+			continue
+		}
+
+		if u.config.Sync.Enabled {
+			u.replaceFiles(dest)
+			if time.Now().Before(u.retryAt[dest.Name()]) {
+				continue
+			}
+		}
+
+		u.submitForReview(dest)
+
+		plan := planBatch(u.queue, dest.Name(), u.capabilities(dest), u.config.Upload.BatchSize, func(first, item *queuedFile) bool {
+			return u.sameThread(dest, first, item)
+		})
+
+		for item, reason := range plan.rejected {
+			u.rejectFile(item, dest, reason)
+		}
+
+		if len(plan.batch) > 0 {
+			log.Printf("Uploading batch of %d files to %s", len(plan.batch), dest.Name())
+			u.uploadToDestination(dest, plan.batch)
+		}
+	}
+
+	remaining := u.queue[:0]
+	for _, item := range u.queue {
+		switch {
+		case len(item.pending) > 0:
+			remaining = append(remaining, item)
+		case item.rejected:
+			log.Printf("Removing %s from queue, it was rejected by at least one destination", item.path)
+		default:
+			u.handleCompletedFile(item.path)
+		}
+	}
+	u.queue = remaining
+}
+
+func (u *Uploader) uploadToDestination(dest destination.Destination, batch []*queuedFile) {
+	message := destination.Message{
+		Content: u.renderContent(dest, batch),
 	}
+	threadKey := u.applyThread(dest, batch, &message)
 
-	batch := u.queue[:batchSize]
-	u.queue = u.queue[batchSize:]
+	nonce := u.beginUpload(dest, batch, message)
+	message.Nonce = nonce
 
-	log.Printf("Uploading batch of %d files", len(batch))
+	var result *destination.Result
+	var err error
 
 	if len(batch) == 1 {
-		err := u.discordClient.UploadImage(batch[0])
+		result, err = dest.Upload(u.ctx, batch[0].path, message)
 		if err != nil {
-			log.Printf("Failed to upload %s: %v", batch[0], err)
-			u.queue = append([]string{batch[0]}, u.queue...)
-			return
+			log.Printf("Failed to upload %s to %s: %v", batch[0].path, dest.Name(), err)
 		}
-		u.handleSuccessfulUpload(batch[0])
 	} else {
-		err := u.discordClient.UploadImages(batch)
+		files := make([]string, len(batch))
+		for i, item := range batch {
+			files[i] = item.path
+		}
+
+		result, err = dest.UploadBatch(u.ctx, files, message)
 		if err != nil {
-			log.Printf("Failed to upload batch: %v", err)
-			u.queue = append(batch, u.queue...)
-			return
+			log.Printf("Failed to upload batch to %s: %v", dest.Name(), err)
+		}
+	}
+
+	// A new thread may exist even if the message failed; remembering it
+	// keeps the retry from creating another one.
+	if result != nil {
+		u.rememberThread(dest, threadKey, message, result)
+	}
+
+	// Unless the request never left, it may have reached Discord before it
+	// was cancelled, so the journal entry is kept for the next start to
+	// check.
+	if err != nil && u.ctx.Err() != nil {
+		if errors.Is(err, destination.ErrNotSent) {
+			u.finishUpload(nonce)
+		}
+		log.Printf("Upload to %s was cancelled, keeping %d files queued", dest.Name(), len(batch))
+		return
+	}
+	defer u.finishUpload(nonce)
+
+	if err != nil {
+		u.recordError("upload to %s failed: %v", dest.Name(), err)
+		u.handleRateLimit(dest, err)
+		u.forgetThread(dest, threadKey, err)
+		return
+	}
+
+	for _, item := range batch {
+		file, ok := result.File(item.path)
+		if !ok {
+			file = destination.FileResult{
+				Path:   item.path,
+				Status: destination.FileFailed,
+				Reason: "no result reported by destination",
+			}
 		}
 
-		for _, file := range batch {
-			u.handleSuccessfulUpload(file)
+		if file.Status == destination.FileSent {
+			u.handleSuccessfulUpload(dest, item, result, file)
+		} else {
+			u.handleFailedFile(dest, item, file)
 		}
 	}
 }
 
+// handleFailedFile keeps a file that didn't get through pending for the
+// destination, so it is retried with the next batch. After maxFileAttempts
+// it is rejected there.
+func (u *Uploader) handleFailedFile(dest destination.Destination, item *queuedFile, file destination.FileResult) {
+	if item.attempts == nil {
+		item.attempts = make(map[string]int)
+	}
+	item.attempts[dest.Name()]++
+	u.recordError("%s was %s by %s: %s", item.path, file.Status, dest.Name(), file.Reason)
+
+	if item.attempts[dest.Name()] >= maxFileAttempts {
+		u.rejectFile(item, dest, fmt.Sprintf("%s %d times, last reason: %s", file.Status, item.attempts[dest.Name()], file.Reason))
+		return
+	}
+
+	log.Printf("File %s was %s by %s, will retry: %s", item.path, file.Status, dest.Name(), file.Reason)
+}
+
+// rejectFile takes a file off a destination for good because it can't be
+// sent there. It is kept out of the queue until it changes on disk.
+func (u *Uploader) rejectFile(item *queuedFile, dest destination.Destination, reason string) {
+	log.Printf("Rejecting %s for %s: %s", item.path, dest.Name(), reason)
+	u.recordError("%s rejected by %s: %s", item.path, dest.Name(), reason)
+
+	item.dropPending(dest.Name())
+	item.rejected = true
+
+	record := rejection{destination: dest.Name(), reason: reason}
+	if stat, err := os.Stat(item.path); err == nil {
+		record.size = stat.Size()
+		record.modTime = stat.ModTime()
+	}
+	u.rejected[item.path] = record
+}
+
+func (u *Uploader) isRejected(file string) bool {
+	record, exists := u.rejected[file]
+	if !exists {
+		return false
+	}
+
+	stat, err := os.Stat(file)
+	if err == nil && (stat.Size() != record.size || !stat.ModTime().Equal(record.modTime)) {
+		delete(u.rejected, file)
+		return false
+	}
+
+	return true
+}
+
+func (u *Uploader) handleRateLimit(dest destination.Destination, err error) {
+	var rateLimitErr *destination.RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		return
+	}
+
+	u.retryAt[dest.Name()] = rateLimitErr.RetryAt
+	log.Printf("Discord rate limit hit on %s, pausing uploads there until %s", dest.Name(), rateLimitErr.RetryAt.Format(time.TimeOnly))
+}
+
 func (u *Uploader) watchForNewFiles() {
 	eventChan := u.watcher.GetEventChan()
+	removedChan := u.watcher.GetRemovedChan()
 
 	for {
 		select {
@@ -164,33 +420,116 @@ func (u *Uploader) watchForNewFiles() {
 			}
 			u.addToQueue(file)
 
+		case file, ok := <-removedChan:
+			if !ok {
+				return
+			}
+			u.handleRemovedFile(file)
+
 		case <-u.doneChan:
 			return
 		}
 	}
 }
 
-func (u *Uploader) handleSuccessfulUpload(file string) {
-	err := u.history.MarkUploaded(file, "")
+func (u *Uploader) handleSuccessfulUpload(dest destination.Destination, item *queuedFile, result *destination.Result, file destination.FileResult) {
+	item.dropPending(dest.Name())
+	delete(item.attempts, dest.Name())
+	u.recordUpload()
+	u.finishReview(dest, item)
+	attachment := file.Attachment
+
+	err := u.history.MarkDelivered(item.path, dest.Name(), history.Delivery{
+		MessageID:    result.MessageID,
+		ChannelID:    result.ChannelID,
+		WebhookID:    result.WebhookID,
+		ThreadID:     result.ThreadID,
+		AttachmentID: attachment.ID,
+		DiscordURL:   attachment.URL,
+	})
 	if err != nil {
 		log.Printf("Warning: failed to mark file as uploaded in history: %v", err)
 	}
+}
 
-	err = u.watcher.DeleteFile(file)
+// handleCompletedFile runs once a file has reached all of its destinations.
+func (u *Uploader) handleCompletedFile(file string) {
+	err := u.watcher.DeleteFile(file)
 	if err != nil {
 		log.Printf("Warning: failed to delete file after upload: %v", err)
 	}
 }
 
-func (u *Uploader) isValidFile(file string) bool {
+func (u *Uploader) destinationNames() []string {
+	names := make([]string, len(u.destinations))
+	for i, dest := range u.destinations {
+		names[i] = dest.Name()
+	}
+	return names
+}
+
+func (u *Uploader) isQueued(file string) bool {
+	for _, item := range u.queue {
+		if item.path == file {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *queuedFile) isPendingFor(name string) bool {
+	for _, pending := range q.pending {
+		if pending == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isReadyFor reports whether the file can go into the next batch for the
+// destination. Edited files and files under review are handled separately.
+func (q *queuedFile) isReadyFor(name string) bool {
+	if !q.isPendingFor(name) {
+		return false
+	}
+	if _, replacing := q.replaces[name]; replacing {
+		return false
+	}
+	return !q.inReview[name]
+}
+
+func (q *queuedFile) dropPending(name string) {
+	remaining := q.pending[:0]
+	for _, pending := range q.pending {
+		if pending != name {
+			remaining = append(remaining, pending)
+		}
+	}
+	q.pending = remaining
+}
+
+// isValidFile checks the file against the largest upload limit of its
+// targets. Limits of the single destinations are enforced by planBatch.
+func (u *Uploader) isValidFile(file string, targets []string) bool {
 	stat, err := os.Stat(file)
 	if err != nil {
 		log.Printf("Cannot stat file %s: %v", file, err)
 		return false
 	}
 
-	maxSizeBytes := int64(u.config.Upload.MaxFileSizeMB) * 1024 * 1024
-	if stat.Size() > maxSizeBytes {
+	var maxSizeBytes int64
+	for _, dest := range u.destinations {
+		for _, target := range targets {
+			if dest.Name() != target {
+				continue
+			}
+			if limit := u.capabilities(dest).MaxFileBytes; limit > maxSizeBytes {
+				maxSizeBytes = limit
+			}
+		}
+	}
+
+	if maxSizeBytes > 0 && stat.Size() > maxSizeBytes {
 		log.Printf("File %s is too large (%d bytes, max: %d bytes)", file, stat.Size(), maxSizeBytes)
 		return false
 	}
@@ -198,6 +537,19 @@ func (u *Uploader) isValidFile(file string) bool {
 	return true
 }
 
+// capabilities applies upload.max_file_size_mb as a cap on the limits the
+// destination reports.
+func (u *Uploader) capabilities(dest destination.Destination) destination.Capabilities {
+	caps := dest.Capabilities()
+
+	limit := int64(u.config.Upload.MaxFileSizeMB) * 1024 * 1024
+	if limit > 0 && (caps.MaxFileBytes == 0 || limit < caps.MaxFileBytes) {
+		caps.MaxFileBytes = limit
+	}
+
+	return caps
+}
+
 func (u *Uploader) GetQueueLength() int {
 	u.queueMutex.RLock()
 	defer u.queueMutex.RUnlock()
@@ -0,0 +1,321 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"discord-image-uploader/internal/config"
+	"discord-image-uploader/internal/destination"
+	"discord-image-uploader/internal/history"
+	"discord-image-uploader/internal/state"
+	"discord-image-uploader/internal/watcher"
+)
+
+// newTestUploader returns an uploader for the images in dir. History and
+// state live in dir/data, so a second uploader on the same dir behaves
+// like a restart.
+func newTestUploader(t *testing.T, dir string, batchSize int, destinations ...destination.Destination) *Uploader {
+	t.Helper()
+
+	cfg := &config.Config{}
+	for _, dest := range destinations {
+		cfg.Discord.Destinations = append(cfg.Discord.Destinations, config.DestinationConfig{Name: dest.Name()})
+	}
+	cfg.Watcher.Folders = []config.FolderConfig{{Path: dir}}
+	cfg.Upload.BatchSize = batchSize
+	cfg.Upload.IntervalSeconds = 1
+
+	fileWatcher, err := watcher.New([]watcher.Root{{Path: dir, SupportedFormats: []string{".png"}}}, watcher.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fileWatcher.Stop)
+
+	uploadHistory, err := history.New(filepath.Join(dir, "data", "history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stateStore, err := state.New(filepath.Join(dir, "data", "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(cfg, destinations, nil, fileWatcher, uploadHistory, stateStore)
+}
+
+func writeImages(t *testing.T, dir string, names ...string) []string {
+	t.Helper()
+
+	var files []string
+	for _, name := range names {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte("image "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// fakeDestination records every send. respond decides the result of a send;
+// by default every file gets through.
+type fakeDestination struct {
+	name     string
+	caps     destination.Capabilities
+	respond  func(files []string) (*destination.Result, error)
+	sends    [][]string
+	messages []destination.Message
+}
+
+func (f *fakeDestination) Name() string                           { return f.name }
+func (f *fakeDestination) Test(ctx context.Context) error         { return nil }
+func (f *fakeDestination) Close() error                           { return nil }
+func (f *fakeDestination) Capabilities() destination.Capabilities { return f.caps }
+
+func (f *fakeDestination) Upload(ctx context.Context, filePath string, message destination.Message) (*destination.Result, error) {
+	return f.UploadBatch(ctx, []string{filePath}, message)
+}
+
+func (f *fakeDestination) UploadBatch(ctx context.Context, filePaths []string, message destination.Message) (*destination.Result, error) {
+	f.sends = append(f.sends, filePaths)
+	f.messages = append(f.messages, message)
+	if f.respond != nil {
+		return f.respond(filePaths)
+	}
+	return sentResult(filePaths, nil), nil
+}
+
+// sentResult reports every file as sent except those with a status in
+// failed.
+func sentResult(files []string, failed map[string]destination.FileStatus) *destination.Result {
+	result := &destination.Result{MessageID: "m1", ChannelID: "c1"}
+	for i, file := range files {
+		status, ok := failed[file]
+		if !ok {
+			status = destination.FileSent
+		}
+		result.Files = append(result.Files, destination.FileResult{
+			Path:       file,
+			Status:     status,
+			Reason:     "test",
+			Attachment: destination.Attachment{ID: string(rune('a' + i))},
+		})
+	}
+	return result
+}
+
+func (u *Uploader) isDelivered(file, name string) bool {
+	_, delivered := u.history.GetDeliveries(file)[name]
+	return delivered
+}
+
+func TestUploadFansOutToEveryDestination(t *testing.T) {
+	dir := t.TempDir()
+	files := writeImages(t, dir, "a.png", "b.png")
+	first := &fakeDestination{name: "first"}
+	second := &fakeDestination{name: "second"}
+
+	u := newTestUploader(t, dir, 5, first, second)
+	u.addToQueue(files...)
+	u.uploadBatch()
+
+	for _, dest := range []*fakeDestination{first, second} {
+		if !reflect.DeepEqual(dest.sends, [][]string{files}) {
+			t.Errorf("%s got %v, want one batch of %v", dest.name, dest.sends, files)
+		}
+		for _, file := range files {
+			if !u.isDelivered(file, dest.name) {
+				t.Errorf("%s isn't recorded as delivered to %s", file, dest.name)
+			}
+		}
+	}
+
+	if u.GetQueueLength() != 0 {
+		t.Errorf("%d files left in queue", u.GetQueueLength())
+	}
+
+	// A delivered file isn't queued again.
+	u.addToQueue(files...)
+	if u.GetQueueLength() != 0 {
+		t.Errorf("delivered files were queued again")
+	}
+}
+
+func TestUploadBatchSizeLimitsFilesPerSend(t *testing.T) {
+	dir := t.TempDir()
+	files := writeImages(t, dir, "a.png", "b.png", "c.png")
+	dest := &fakeDestination{name: "hook"}
+
+	u := newTestUploader(t, dir, 2, dest)
+	u.addToQueue(files...)
+	u.uploadBatch()
+	u.uploadBatch()
+
+	want := [][]string{files[:2], files[2:]}
+	if !reflect.DeepEqual(dest.sends, want) {
+		t.Errorf("sends = %v, want %v", dest.sends, want)
+	}
+}
+
+func TestPartialResultKeepsFailedFilesPending(t *testing.T) {
+	dir := t.TempDir()
+	files := writeImages(t, dir, "a.png", "b.png")
+	dest := &fakeDestination{name: "hook"}
+	dest.respond = func(batch []string) (*destination.Result, error) {
+		if len(dest.sends) == 1 {
+			return sentResult(batch, map[string]destination.FileStatus{files[1]: destination.FileSkipped}), nil
+		}
+		return sentResult(batch, nil), nil
+	}
+
+	u := newTestUploader(t, dir, 5, dest)
+	u.addToQueue(files...)
+	u.uploadBatch()
+
+	if !u.isDelivered(files[0], "hook") {
+		t.Error("sent file isn't recorded as delivered")
+	}
+	if u.isDelivered(files[1], "hook") {
+		t.Error("skipped file is recorded as delivered")
+	}
+	if u.GetQueueLength() != 1 || u.queue[0].attempts["hook"] != 1 {
+		t.Fatalf("skipped file isn't pending with one attempt: %+v", u.queue)
+	}
+
+	u.uploadBatch()
+
+	if !reflect.DeepEqual(dest.sends[1], files[1:]) {
+		t.Errorf("retry sent %v, want %v", dest.sends[1], files[1:])
+	}
+	if !u.isDelivered(files[1], "hook") || u.GetQueueLength() != 0 {
+		t.Error("retried file wasn't delivered")
+	}
+}
+
+func TestFileIsRejectedAfterMaxAttempts(t *testing.T) {
+	dir := t.TempDir()
+	files := writeImages(t, dir, "bad.png")
+	dest := &fakeDestination{name: "hook"}
+	dest.respond = func(batch []string) (*destination.Result, error) {
+		return sentResult(batch, map[string]destination.FileStatus{files[0]: destination.FileFailed}), nil
+	}
+
+	u := newTestUploader(t, dir, 5, dest)
+	u.addToQueue(files...)
+	for i := 0; i < maxFileAttempts; i++ {
+		u.uploadBatch()
+	}
+
+	if len(dest.sends) != maxFileAttempts {
+		t.Errorf("file was sent %d times, want %d", len(dest.sends), maxFileAttempts)
+	}
+	if u.GetQueueLength() != 0 {
+		t.Fatal("rejected file is still queued")
+	}
+
+	u.addToQueue(files...)
+	if u.GetQueueLength() != 0 {
+		t.Fatal("rejected file was queued again without changing")
+	}
+
+	// A changed file gets another chance.
+	if err := os.WriteFile(files[0], []byte("fixed image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	u.addToQueue(files...)
+	if u.GetQueueLength() != 1 {
+		t.Fatal("changed file wasn't queued again")
+	}
+}
+
+func TestRateLimitPausesOnlyThatDestination(t *testing.T) {
+	dir := t.TempDir()
+	files := writeImages(t, dir, "a.png")
+	limited := &fakeDestination{name: "limited"}
+	limited.respond = func(batch []string) (*destination.Result, error) {
+		if len(limited.sends) == 1 {
+			return nil, destination.NewRateLimitError("webhook", time.Minute, false)
+		}
+		return sentResult(batch, nil), nil
+	}
+	other := &fakeDestination{name: "other"}
+
+	u := newTestUploader(t, dir, 5, limited, other)
+	u.addToQueue(files...)
+	u.uploadBatch()
+
+	retryAt := u.retryAt["limited"]
+	if time.Until(retryAt) < 50*time.Second || time.Until(retryAt) > time.Minute {
+		t.Fatalf("retryAt = %s, want about a minute from now", retryAt)
+	}
+	if !u.isDelivered(files[0], "other") {
+		t.Error("other destination wasn't served")
+	}
+
+	u.uploadBatch()
+	if len(limited.sends) != 1 {
+		t.Fatalf("limited destination was called %d times before retryAt", len(limited.sends))
+	}
+
+	u.retryAt["limited"] = time.Now().Add(-time.Second)
+	u.uploadBatch()
+	if len(limited.sends) != 2 || !u.isDelivered(files[0], "limited") {
+		t.Error("limited destination wasn't retried after retryAt")
+	}
+}
+
+func TestUploadErrorWithoutResultCountsNoAttempt(t *testing.T) {
+	dir := t.TempDir()
+	files := writeImages(t, dir, "a.png")
+	dest := &fakeDestination{name: "hook"}
+	dest.respond = func(batch []string) (*destination.Result, error) {
+		return nil, errors.New("connection reset")
+	}
+
+	u := newTestUploader(t, dir, 5, dest)
+	u.addToQueue(files...)
+	for i := 0; i < maxFileAttempts+1; i++ {
+		u.uploadBatch()
+	}
+
+	if u.GetQueueLength() != 1 {
+		t.Fatal("file was dropped after failed requests")
+	}
+	if pending := u.state.PendingUploads(); len(pending) != 0 {
+		t.Errorf("journal kept %d failed uploads", len(pending))
+	}
+}
+
+func TestRetryAfterFailedSendReusesNewThread(t *testing.T) {
+	dir := t.TempDir()
+	files := writeImages(t, dir, "a.png")
+	dest := &fakeDestination{name: "bot"}
+	dest.respond = func(batch []string) (*destination.Result, error) {
+		if len(dest.sends) == 1 {
+			return &destination.Result{ChannelID: "t1", ThreadID: "t1"}, errors.New("message refused")
+		}
+		return sentResult(batch, nil), nil
+	}
+
+	u := newTestUploader(t, dir, 5, dest)
+	u.destinationConfigs["bot"] = config.DestinationConfig{Name: "bot", Thread: config.ThreadConfig{Strategy: "session"}}
+	u.addToQueue(files...)
+	u.uploadBatch()
+	u.uploadBatch()
+
+	if len(dest.messages) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(dest.messages))
+	}
+	if first := dest.messages[0]; first.ThreadName == "" {
+		t.Errorf("first send didn't ask for a new thread: %+v", first)
+	}
+	if retry := dest.messages[1]; retry.ThreadID != "t1" || retry.ThreadName != "" {
+		t.Errorf("retry = %+v, want it posted into thread t1", retry)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package watcher
+
+import "io/fs"
+
+// fileID returns 0 where FileInfo carries no file ID, leaving snapshots to
+// compare size and modification time.
+func fileID(info fs.FileInfo) uint64 {
+	return 0
+}
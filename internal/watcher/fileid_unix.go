@@ -0,0 +1,17 @@
+//go:build unix
+
+package watcher
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileID returns the inode of a file, which changes when a file is
+// replaced rather than written to.
+func fileID(info fs.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
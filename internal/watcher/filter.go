@@ -0,0 +1,192 @@
+package watcher
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"discord-image-uploader/internal/caption"
+)
+
+// Filter narrows down the files of a root beyond the supported formats.
+// Globs and regular expressions are matched against the slash-separated
+// path relative to the root. A glob without a slash is matched against the
+// name only, ** matches any number of folders. Zero sizes and ages mean no
+// limit.
+type Filter struct {
+	Include       []string
+	Exclude       []string
+	IncludeRegex  []string
+	ExcludeRegex  []string
+	ExcludeHidden bool
+	MinSize       int64
+	MaxSize       int64
+	MinAge        time.Duration
+	MaxAge        time.Duration
+}
+
+type compiledFilter struct {
+	Filter
+	includeRegex []*regexp.Regexp
+	excludeRegex []*regexp.Regexp
+}
+
+func compileFilter(f Filter) (*compiledFilter, error) {
+	compiled := &compiledFilter{Filter: f}
+
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+
+	for _, expr := range f.IncludeRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include regex %q: %w", expr, err)
+		}
+		compiled.includeRegex = append(compiled.includeRegex, re)
+	}
+
+	for _, expr := range f.ExcludeRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude regex %q: %w", expr, err)
+		}
+		compiled.excludeRegex = append(compiled.excludeRegex, re)
+	}
+
+	return compiled, nil
+}
+
+// skipDir returns why a folder is left out, or "". Include patterns only
+// apply to files.
+func (f *compiledFilter) skipDir(relPath string) string {
+	if f.ExcludeHidden && isHidden(relPath) {
+		return "hidden folder"
+	}
+	return f.excludeReason(relPath)
+}
+
+// skipFile returns why a file is left out, or "". For files that are too
+// young it also returns how long until they are old enough.
+func (f *compiledFilter) skipFile(relPath string, info fs.FileInfo) (string, time.Duration) {
+	if f.ExcludeHidden && isHidden(relPath) {
+		return "hidden file", 0
+	}
+
+	if reason := f.excludeReason(relPath); reason != "" {
+		return reason, 0
+	}
+
+	if (len(f.Include) > 0 || len(f.includeRegex) > 0) && !f.isIncluded(relPath) {
+		return "matches no include pattern", 0
+	}
+
+	if f.MinSize > 0 && info.Size() < f.MinSize {
+		return fmt.Sprintf("smaller than %s", caption.HumanizeBytes(f.MinSize)), 0
+	}
+
+	if f.MaxSize > 0 && info.Size() > f.MaxSize {
+		return fmt.Sprintf("larger than %s", caption.HumanizeBytes(f.MaxSize)), 0
+	}
+
+	age := time.Since(info.ModTime())
+	if f.MinAge > 0 && age < f.MinAge {
+		return fmt.Sprintf("younger than %s", f.MinAge), f.MinAge - age
+	}
+
+	if f.MaxAge > 0 && age > f.MaxAge {
+		return fmt.Sprintf("older than %s", f.MaxAge), 0
+	}
+
+	return "", 0
+}
+
+func (f *compiledFilter) excludeReason(relPath string) string {
+	for _, pattern := range f.Exclude {
+		if matchGlob(pattern, relPath) {
+			return fmt.Sprintf("matches exclude pattern %q", pattern)
+		}
+	}
+
+	for _, re := range f.excludeRegex {
+		if re.MatchString(relPath) {
+			return fmt.Sprintf("matches exclude regex %q", re.String())
+		}
+	}
+
+	return ""
+}
+
+func (f *compiledFilter) isIncluded(relPath string) bool {
+	for _, pattern := range f.Include {
+		if matchGlob(pattern, relPath) {
+			return true
+		}
+	}
+
+	for _, re := range f.includeRegex {
+		if re.MatchString(relPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isHidden(relPath string) bool {
+	for _, part := range strings.Split(relPath, "/") {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches relPath against pattern. A leading slash anchors the
+// pattern at the root, which it is anyway once it contains a slash.
+func matchGlob(pattern, relPath string) bool {
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	if !anchored {
+		matched, _ := path.Match(pattern, path.Base(relPath))
+		return matched
+	}
+
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(relPath, "/"))
+}
+
+// matchSegments matches path segments, with ** standing for any number of
+// folders. A trailing ** only matches what is inside a folder, like in
+// .gitignore, so "raw/**" doesn't match raw itself.
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return len(parts) > 0
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(parts) == 0 {
+			return false
+		}
+
+		if matched, _ := path.Match(pattern[0], parts[0]); !matched {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+
+	return len(parts) == 0
+}
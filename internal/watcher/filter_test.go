@@ -0,0 +1,140 @@
+package watcher
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		relPath string
+		want    bool
+	}{
+		{"*.png", "top.png", true},
+		{"*.png", "a/b/deep.png", true},
+		{"*.png", "top.jpg", false},
+		{"/top.png", "top.png", true},
+		{"/top.png", "a/top.png", false},
+		{"/*.png", "a/top.png", false},
+		{"a/*.png", "a/x.png", true},
+		{"a/*.png", "b/a/x.png", false},
+		{"a/*.png", "a/b/x.png", false},
+		{"a/**/*.png", "a/x.png", true},
+		{"a/**/*.png", "a/b/c/x.png", true},
+		{"**/raw/*", "x/y/raw/z.png", true},
+		{"**/raw/*", "raw/z.png", true},
+		{"**/raw/*", "raw.png", false},
+	}
+
+	for _, test := range tests {
+		if got := matchGlob(test.pattern, test.relPath); got != test.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", test.pattern, test.relPath, got, test.want)
+		}
+	}
+}
+
+type fakeFileInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (f fakeFileInfo) Name() string       { return "file" }
+func (f fakeFileInfo) Size() int64        { return f.size }
+func (f fakeFileInfo) Mode() fs.FileMode  { return 0644 }
+func (f fakeFileInfo) ModTime() time.Time { return f.modTime }
+func (f fakeFileInfo) IsDir() bool        { return false }
+func (f fakeFileInfo) Sys() interface{}   { return nil }
+
+func TestSkipFile(t *testing.T) {
+	old := fakeFileInfo{size: 1000, modTime: time.Now().Add(-time.Hour)}
+
+	tests := []struct {
+		name    string
+		filter  Filter
+		relPath string
+		info    fakeFileInfo
+		skipped bool
+	}{
+		{"no filter", Filter{}, "a.png", old, false},
+		{"include matches", Filter{Include: []string{"keep/**"}}, "keep/a.png", old, false},
+		{"include misses", Filter{Include: []string{"keep/**"}}, "other/a.png", old, true},
+		{"include regex", Filter{IncludeRegex: []string{`^shots/\d+\.png$`}}, "shots/12.png", old, false},
+		{"exclude wins over include", Filter{Include: []string{"*.png"}, Exclude: []string{"*_draft.png"}}, "x_draft.png", old, true},
+		{"exclude regex", Filter{ExcludeRegex: []string{`tmp`}}, "a/tmp/x.png", old, true},
+		{"hidden file", Filter{ExcludeHidden: true}, ".secret.png", old, true},
+		{"hidden folder", Filter{ExcludeHidden: true}, ".cache/a.png", old, true},
+		{"hidden allowed", Filter{}, ".secret.png", old, false},
+		{"too small", Filter{MinSize: 2000}, "a.png", old, true},
+		{"too large", Filter{MaxSize: 500}, "a.png", old, true},
+		{"size in range", Filter{MinSize: 500, MaxSize: 2000}, "a.png", old, false},
+		{"too old", Filter{MaxAge: time.Minute}, "a.png", old, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := compileFilter(test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reason, wait := filter.skipFile(test.relPath, test.info)
+			if (reason != "") != test.skipped {
+				t.Errorf("skipFile(%q) = %q, want skipped = %v", test.relPath, reason, test.skipped)
+			}
+			if wait != 0 {
+				t.Errorf("skipFile(%q) asks to wait %s", test.relPath, wait)
+			}
+		})
+	}
+}
+
+func TestSkipFileTooYoung(t *testing.T) {
+	filter, err := compileFilter(Filter{MinAge: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reason, wait := filter.skipFile("a.png", fakeFileInfo{modTime: time.Now().Add(-20 * time.Second)})
+	if reason == "" {
+		t.Fatal("young file wasn't skipped")
+	}
+	if wait < 39*time.Second || wait > 40*time.Second {
+		t.Errorf("wait = %s, want about 40s", wait)
+	}
+}
+
+// A file that is too young is reported once it is old enough.
+func TestYoungFileIsRechecked(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New([]Root{{
+		Path:             dir,
+		SupportedFormats: []string{".png"},
+		Filter:           Filter{MinAge: 300 * time.Millisecond},
+	}}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	defer w.Stop()
+
+	file := filepath.Join(dir, "young.png")
+	if err := os.WriteFile(file, []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-w.GetEventChan():
+		if got != file {
+			t.Fatalf("got %s, want %s", got, file)
+		}
+		if info, err := os.Stat(file); err != nil || time.Since(info.ModTime()) < 300*time.Millisecond {
+			t.Fatal("file was reported before it was old enough")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("young file was never reported")
+	}
+}
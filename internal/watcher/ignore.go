@@ -0,0 +1,161 @@
+package watcher
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A .uploadignore file excludes files in its folder and below, with the
+// syntax of .gitignore: # comments, ! negations, a trailing / for folders
+// only, and patterns containing a slash anchored at the file's folder.
+// Rules of deeper files come later and win, and nothing inside an excluded
+// folder can be included again.
+const ignoreFileName = ".uploadignore"
+
+type ignoreRule struct {
+	segments []string
+	anchored bool
+	dirOnly  bool
+	negate   bool
+}
+
+func parseIgnoreFile(data string) []ignoreRule {
+	var rules []ignoreRule
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			// \# and \! start patterns with a literal # or !.
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+
+		if line == "" {
+			continue
+		}
+
+		rule.segments = strings.Split(line, "/")
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// matches checks relPath, relative to the folder of the ignore file.
+func (r ignoreRule) matches(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	if r.anchored {
+		return matchSegments(r.segments, strings.Split(relPath, "/"))
+	}
+
+	matched, _ := path.Match(r.segments[0], path.Base(relPath))
+	return matched
+}
+
+// ignoreRules returns the rules of the ignore file in dir, reading it on
+// first use.
+func (w *Watcher) ignoreRules(dir string) []ignoreRule {
+	w.ignoreMutex.Lock()
+	defer w.ignoreMutex.Unlock()
+
+	if rules, cached := w.ignores[dir]; cached {
+		return rules
+	}
+
+	var rules []ignoreRule
+	data, err := os.ReadFile(filepath.Join(dir, ignoreFileName))
+	if err == nil {
+		rules = parseIgnoreFile(string(data))
+	} else if !os.IsNotExist(err) {
+		log.Printf("Warning: failed to read %s: %v", filepath.Join(dir, ignoreFileName), err)
+	}
+
+	w.ignores[dir] = rules
+	return rules
+}
+
+// isIgnored checks path against the ignore files from its root down to
+// its folder. The folders on the way are checked first, since an excluded
+// folder excludes everything inside.
+func (w *Watcher) isIgnored(root *Root, filePath string, isDir bool) bool {
+	rel := w.relSlashPath(root, filePath)
+	if rel == "." {
+		return false
+	}
+
+	parts := strings.Split(rel, "/")
+	for i := 1; i <= len(parts); i++ {
+		if w.matchIgnoreFiles(root, parts[:i], i < len(parts) || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchIgnoreFiles applies the rules of every ignore file above parts in
+// order. The last matching rule decides.
+func (w *Watcher) matchIgnoreFiles(root *Root, parts []string, isDir bool) bool {
+	ignored := false
+
+	for i := 0; i < len(parts); i++ {
+		dir := filepath.Join(append([]string{root.Path}, parts[:i]...)...)
+		rel := strings.Join(parts[i:], "/")
+
+		for _, rule := range w.ignoreRules(dir) {
+			if rule.matches(rel, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored
+}
+
+// reloadIgnoreFile drops the cached rules of a changed ignore file. Folders
+// it no longer excludes are watched from now on; files in them that
+// already exist are picked up with the next start.
+func (w *Watcher) reloadIgnoreFile(file string) {
+	dir := filepath.Dir(file)
+
+	w.ignoreMutex.Lock()
+	delete(w.ignores, dir)
+	w.ignoreMutex.Unlock()
+
+	log.Printf("Reloaded %s", file)
+
+	if w.mode == ModeAuto {
+		// Files the change brings into view have no events of their own.
+		w.markSeen(dir)
+	}
+
+	if !w.watchedDirs[dir] {
+		return
+	}
+
+	if _, err := w.watchTree(dir); err != nil {
+		log.Printf("Failed to watch subfolders of %s: %v", dir, err)
+	}
+}
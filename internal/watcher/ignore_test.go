@@ -0,0 +1,83 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsIgnored(t *testing.T) {
+	tests := []struct {
+		name    string
+		ignores map[string]string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"name anywhere", map[string]string{".": "*.tmp.png"}, "a/b/x.tmp.png", false, true},
+		{"name no match", map[string]string{".": "*.tmp.png"}, "a/b/x.png", false, false},
+		{"anchored at root", map[string]string{".": "/top.png"}, "top.png", false, true},
+		{"anchored not deeper", map[string]string{".": "/top.png"}, "a/top.png", false, false},
+		{"anchored path", map[string]string{".": "a/b.png"}, "a/b.png", false, true},
+		{"anchored path not deeper", map[string]string{".": "a/b.png"}, "x/a/b.png", false, false},
+		{"anchored at its folder", map[string]string{"sub": "/x.png"}, "sub/x.png", false, true},
+		{"anchored not above its folder", map[string]string{"sub": "/x.png"}, "x.png", false, false},
+		{"negation", map[string]string{".": "*.png\n!keep.png"}, "keep.png", false, false},
+		{"negation order", map[string]string{".": "!keep.png\n*.png"}, "keep.png", false, true},
+		{"deeper file wins", map[string]string{".": "*.png", "sub": "!keep.png"}, "sub/keep.png", false, false},
+		{"dir only matches folder", map[string]string{".": "drafts/"}, "drafts", true, true},
+		{"dir only skips file", map[string]string{".": "drafts/"}, "drafts", false, false},
+		{"dir only excludes contents", map[string]string{".": "drafts/"}, "a/drafts/x.png", false, true},
+		{"no reinclude in excluded folder", map[string]string{".": "drafts/\n!drafts/keep.png"}, "drafts/keep.png", false, true},
+		{"leading double star", map[string]string{".": "**/raw.png"}, "raw.png", false, true},
+		{"leading double star deep", map[string]string{".": "**/raw.png"}, "a/b/raw.png", false, true},
+		{"inner double star", map[string]string{".": "a/**/x.png"}, "a/x.png", false, true},
+		{"inner double star deep", map[string]string{".": "a/**/x.png"}, "a/b/c/x.png", false, true},
+		{"trailing double star contents", map[string]string{".": "/export/roh/**"}, "export/roh/a.png", false, true},
+		{"trailing double star not folder", map[string]string{".": "/export/roh/**"}, "export/roh", true, false},
+		{"trailing double star reinclude", map[string]string{".": "/export/roh/**\n!/export/roh/keep.png"}, "export/roh/keep.png", false, false},
+		{"comment and escape", map[string]string{".": "# *.png\n\\#x.png"}, "#x.png", false, true},
+		{"comment ignored", map[string]string{".": "# *.png"}, "a.png", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for folder, content := range test.ignores {
+				folder = filepath.Join(dir, folder)
+				if err := os.MkdirAll(folder, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(folder, ignoreFileName), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := &Watcher{ignores: make(map[string][]ignoreRule)}
+			root := &Root{Path: dir}
+			path := filepath.Join(dir, filepath.FromSlash(test.path))
+
+			if got := w.isIgnored(root, path, test.isDir); got != test.want {
+				t.Errorf("isIgnored(%q) with %q = %v, want %v", test.path, test.ignores, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	rules := parseIgnoreFile("# comment\n\n!/a/b/\n**/c  \n")
+	if len(rules) != 2 {
+		t.Fatalf("got %d rules, want 2", len(rules))
+	}
+
+	first := rules[0]
+	if !first.negate || !first.anchored || !first.dirOnly || strings.Join(first.segments, "/") != "a/b" {
+		t.Errorf("first rule = %+v", first)
+	}
+
+	second := rules[1]
+	if second.negate || !second.anchored || second.dirOnly || strings.Join(second.segments, "/") != "**/c" {
+		t.Errorf("second rule = %+v", second)
+	}
+}
@@ -0,0 +1,253 @@
+package watcher
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Mode selects how a Watcher detects changes. Polling compares snapshots of
+// the roots and works where fsnotify gets no events, e.g. on network shares
+// or bind mounts of Docker Desktop. In auto mode the snapshots only verify
+// the events; a root whose changes fsnotify misses is polled from then on.
+type Mode string
+
+const (
+	ModeFsnotify Mode = "fsnotify"
+	ModePoll     Mode = "poll"
+	ModeAuto     Mode = "auto"
+)
+
+const defaultPollInterval = 5 * time.Second
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+	id      uint64
+	isDir   bool
+}
+
+// snapshot holds the folders, image files and ignore files of a root.
+type snapshot map[string]fileState
+
+func (w *Watcher) pollLoop() {
+	snapshots := make(map[*Root]snapshot)
+	for _, root := range w.roots {
+		snap, err := w.takeSnapshot(root)
+		if err != nil {
+			log.Printf("Warning: failed to poll %s: %v", root.Path, err)
+		}
+		snapshots[root] = snap
+	}
+
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	// Changes fsnotify hasn't reported yet, with the time of the poll
+	// before the one that found them.
+	suspects := make(map[string]time.Time)
+	lastPoll := time.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.doneChan:
+			return
+		}
+
+		now := time.Now()
+		for _, root := range w.roots {
+			snap, err := w.takeSnapshot(root)
+			if err != nil {
+				// An incomplete snapshot would look like deleted files.
+				log.Printf("Warning: failed to poll %s: %v", root.Path, err)
+				continue
+			}
+
+			events := diffSnapshots(snapshots[root], snap)
+			snapshots[root] = snap
+
+			if !w.isPolling(root) {
+				events = w.verifyEvents(root, events, suspects, lastPoll)
+			}
+
+			for _, event := range events {
+				select {
+				case w.pollEvents <- event:
+				case <-w.doneChan:
+					return
+				}
+			}
+		}
+
+		w.forgetSeen(lastPoll)
+		lastPoll = now
+	}
+}
+
+// verifyEvents checks changes found by polling against the events fsnotify
+// reported since the previous poll. A change still missing one poll later
+// switches root over to polling, and the changes missed so far are
+// returned for delivery.
+func (w *Watcher) verifyEvents(root *Root, events []fsnotify.Event, suspects map[string]time.Time, lastPoll time.Time) []fsnotify.Event {
+	var missed []fsnotify.Event
+	for path, since := range suspects {
+		if owner, _ := w.rootOf(path); owner != root {
+			continue
+		}
+		delete(suspects, path)
+
+		if !w.seenSince(root, path, since) {
+			missed = append(missed, fsnotify.Event{Name: path, Op: fsnotify.Create})
+		}
+	}
+
+	if len(missed) > 0 {
+		log.Printf("fsnotify missed %d changes in %s, polling it every %s from now on", len(missed), root.Path, w.pollInterval)
+		w.mutex.Lock()
+		w.polling[root] = true
+		w.mutex.Unlock()
+
+		sort.Slice(missed, func(i, j int) bool { return missed[i].Name < missed[j].Name })
+		return append(missed, events...)
+	}
+
+	for _, event := range events {
+		if !w.seenSince(root, event.Name, lastPoll) {
+			suspects[event.Name] = lastPoll
+		}
+	}
+	return nil
+}
+
+func (w *Watcher) isPolling(root *Root) bool {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.polling[root]
+}
+
+func (w *Watcher) markSeen(path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.seen[path] = time.Now()
+}
+
+// seenSince reports whether fsnotify reported path or one of its folders
+// since the given time. Files of a folder moved in or out of the tree only
+// show up as an event for the folder.
+func (w *Watcher) seenSince(root *Root, path string, since time.Time) bool {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	for {
+		if seen, ok := w.seen[path]; ok && !seen.Before(since) {
+			return true
+		}
+		if path == root.Path {
+			return false
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
+
+func (w *Watcher) forgetSeen(before time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for path, seen := range w.seen {
+		if seen.Before(before) {
+			delete(w.seen, path)
+		}
+	}
+}
+
+// takeSnapshot records every folder, image file and ignore file of root
+// that the watcher would look at. It fails on any read error rather than
+// returning a partial snapshot.
+func (w *Watcher) takeSnapshot(root *Root) (snapshot, error) {
+	snap := make(snapshot)
+
+	err := filepath.WalkDir(root.Path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if owner, _ := w.rootOf(path); owner != root {
+				return filepath.SkipDir
+			}
+			if path != root.Path && (!w.isWithinDepth(path, true) || w.dirSkipReason(root, path) != "") {
+				return filepath.SkipDir
+			}
+		} else if !w.isWithinDepth(path, false) || (!w.isImageFile(path) && entry.Name() != ignoreFileName) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// Deleted while walking.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		snap[path] = fileState{
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			id:      fileID(info),
+			isDir:   info.IsDir(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+// diffSnapshots turns the differences between two snapshots into events,
+// sorted so that a new folder comes before the files inside it. A file
+// with a new inode was replaced and counts as created. Only files that are
+// really gone count as removed.
+func diffSnapshots(old, current snapshot) []fsnotify.Event {
+	if old == nil {
+		return nil
+	}
+
+	var events []fsnotify.Event
+	for path, state := range current {
+		before, existed := old[path]
+		switch {
+		case !existed || before.isDir != state.isDir || before.id != state.id:
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+		case !state.isDir && (before.size != state.size || !before.modTime.Equal(state.modTime)):
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+		}
+	}
+
+	for path := range old {
+		if _, exists := current[path]; exists {
+			continue
+		}
+		// Folders excluded by a changed ignore file drop out of the
+		// snapshot as well, but their files weren't deleted.
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
@@ -0,0 +1,78 @@
+package watcher
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	// gone doesn't exist on disk. dir stands in for a folder that dropped
+	// out of the snapshot, e.g. because it is ignored now, but still exists.
+	gone := filepath.Join(dir, "gone.png")
+	stillThere := dir
+
+	now := time.Now()
+	file := fileState{size: 10, modTime: now, id: 1}
+	folder := fileState{modTime: now, id: 2, isDir: true}
+
+	old := snapshot{
+		filepath.Join(dir, "same.png"):     file,
+		filepath.Join(dir, "grown.png"):    file,
+		filepath.Join(dir, "touched.png"):  file,
+		filepath.Join(dir, "replaced.png"): file,
+		filepath.Join(dir, "sub"):          folder,
+		gone:                               file,
+		stillThere:                         folder,
+	}
+
+	current := snapshot{
+		filepath.Join(dir, "same.png"):       file,
+		filepath.Join(dir, "grown.png"):      {size: 20, modTime: now, id: 1},
+		filepath.Join(dir, "touched.png"):    {size: 10, modTime: now.Add(time.Second), id: 1},
+		filepath.Join(dir, "replaced.png"):   {size: 10, modTime: now, id: 3},
+		filepath.Join(dir, "sub"):            {modTime: now.Add(time.Second), id: 2, isDir: true},
+		filepath.Join(dir, "sub", "new.png"): file,
+		filepath.Join(dir, "new"):            folder,
+	}
+
+	want := []fsnotify.Event{
+		{Name: gone, Op: fsnotify.Remove},
+		{Name: filepath.Join(dir, "grown.png"), Op: fsnotify.Write},
+		{Name: filepath.Join(dir, "new"), Op: fsnotify.Create},
+		{Name: filepath.Join(dir, "replaced.png"), Op: fsnotify.Create},
+		{Name: filepath.Join(dir, "sub", "new.png"), Op: fsnotify.Create},
+		{Name: filepath.Join(dir, "touched.png"), Op: fsnotify.Write},
+	}
+
+	if got := diffSnapshots(old, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffSnapshots =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestDiffSnapshotsWithoutBaseline(t *testing.T) {
+	current := snapshot{"/a.png": {size: 1}}
+	if events := diffSnapshots(nil, current); events != nil {
+		t.Errorf("first snapshot produced %v", events)
+	}
+}
+
+func TestDiffSnapshotsOrdersFoldersFirst(t *testing.T) {
+	current := snapshot{
+		"/r/new/b.png": {},
+		"/r/new":       {isDir: true},
+		"/r/new/a.png": {},
+	}
+
+	var names []string
+	for _, event := range diffSnapshots(snapshot{}, current) {
+		names = append(names, event.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"/r/new", "/r/new/a.png", "/r/new/b.png"}) {
+		t.Errorf("events in order %v", names)
+	}
+}
@@ -2,6 +2,7 @@ package watcher
 
 import (
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
@@ -12,49 +13,136 @@ import (
 	"github.com/fsnotify/fsnotify"
 )
 
+// Root is a watched folder with its own settings. MaxDepth limits how deep
+// files are picked up, like find -maxdepth: 1 is only the folder itself, 0
+// is unlimited.
+type Root struct {
+	Path              string
+	SupportedFormats  []string
+	MaxDepth          int
+	DeleteAfterUpload bool
+	Filter            Filter
+
+	filter *compiledFilter
+}
+
+// Options configures a Watcher. With ReportRemovals set, deleted and
+// renamed image files are reported on GetRemovedChan.
+type Options struct {
+	ReportRemovals bool
+	Mode           Mode
+	PollInterval   time.Duration
+}
+
 type Watcher struct {
-	fsWatcher         *fsnotify.Watcher
-	watchPath         string
-	supportedFormats  []string
-	deleteAfterUpload bool
-	eventChan         chan string
-	doneChan          chan bool
-	processedFiles    map[string]time.Time
-	mutex             sync.RWMutex
+	fsWatcher      *fsnotify.Watcher
+	roots          []*Root
+	mode           Mode
+	pollInterval   time.Duration
+	pollEvents     chan fsnotify.Event
+	eventChan      chan string
+	removedChan    chan string
+	recheckChan    chan string
+	doneChan       chan bool
+	processedFiles map[string]time.Time
+	rechecks       map[string]bool
+	mutex          sync.RWMutex
+	ignores        map[string][]ignoreRule
+	ignoreMutex    sync.Mutex
+	// watchedDirs is only touched by New and watchLoop.
+	watchedDirs map[string]bool
+	// polling and seen are guarded by mutex.
+	polling map[*Root]bool
+	seen    map[string]time.Time
 }
 
-func New(watchPath string, supportedFormats []string, deleteAfterUpload bool) (*Watcher, error) {
+// New creates one watcher for all roots and their subfolders. A folder
+// inside another root belongs to the innermost one.
+func New(roots []Root, opts Options) (*Watcher, error) {
+	if opts.Mode == "" {
+		opts.Mode = ModeFsnotify
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+
 	fsWatcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file system watcher: %w", err)
 	}
 
-	if _, err := os.Stat(watchPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("watch path does not exist: %s", watchPath)
+	w := &Watcher{
+		fsWatcher:      fsWatcher,
+		mode:           opts.Mode,
+		pollInterval:   opts.PollInterval,
+		pollEvents:     make(chan fsnotify.Event),
+		eventChan:      make(chan string, 100),
+		recheckChan:    make(chan string),
+		doneChan:       make(chan bool),
+		processedFiles: make(map[string]time.Time),
+		rechecks:       make(map[string]bool),
+		ignores:        make(map[string][]ignoreRule),
+		watchedDirs:    make(map[string]bool),
+		polling:        make(map[*Root]bool),
+		seen:           make(map[string]time.Time),
+	}
+	if opts.ReportRemovals {
+		w.removedChan = make(chan string, 100)
 	}
 
-	err = fsWatcher.Add(watchPath)
-	if err != nil {
-		fsWatcher.Close()
-		return nil, fmt.Errorf("failed to add watch path: %w", err)
+	for i := range roots {
+		root := roots[i]
+		root.Path = filepath.Clean(root.Path)
+		root.filter, err = compileFilter(root.Filter)
+		if err != nil {
+			fsWatcher.Close()
+			return nil, fmt.Errorf("filter of %s: %w", root.Path, err)
+		}
+		w.roots = append(w.roots, &root)
+	}
+
+	for _, root := range w.roots {
+		if _, err := os.Stat(root.Path); os.IsNotExist(err) {
+			fsWatcher.Close()
+			return nil, fmt.Errorf("watch path does not exist: %s", root.Path)
+		}
+
+		if w.mode == ModePoll {
+			w.polling[root] = true
+		}
+
+		err = w.addWatch(root.Path)
+		if err == nil {
+			w.watchedDirs[root.Path] = true
+			_, err = w.watchTree(root.Path)
+		}
+		if err != nil && w.mode == ModeAuto {
+			// Typically the inotify watch limit or a file system without
+			// notifications.
+			log.Printf("Cannot watch %s for events, polling it instead: %v", root.Path, err)
+			w.polling[root] = true
+			err = nil
+		}
+		if err != nil {
+			fsWatcher.Close()
+			return nil, fmt.Errorf("failed to add watch path %s: %w", root.Path, err)
+		}
 	}
+	log.Printf("Watching %d folders below %d roots (mode: %s)", len(w.watchedDirs), len(w.roots), w.mode)
 
-	return &Watcher{
-		fsWatcher:         fsWatcher,
-		watchPath:         watchPath,
-		supportedFormats:  supportedFormats,
-		deleteAfterUpload: deleteAfterUpload,
-		eventChan:         make(chan string, 100),
-		doneChan:          make(chan bool),
-		processedFiles:    make(map[string]time.Time),
-	}, nil
+	return w, nil
 }
 
 func (w *Watcher) Start() {
-	log.Printf("Starting file watcher for path: %s", w.watchPath)
+	for _, root := range w.roots {
+		log.Printf("Starting file watcher for path: %s", root.Path)
+	}
 
 	go w.watchLoop()
 	go w.cleanupLoop()
+	if w.mode != ModeFsnotify {
+		go w.pollLoop()
+	}
 }
 
 func (w *Watcher) Stop() {
@@ -62,12 +150,20 @@ func (w *Watcher) Stop() {
 	close(w.doneChan)
 	w.fsWatcher.Close()
 	close(w.eventChan)
+	if w.removedChan != nil {
+		close(w.removedChan)
+	}
 }
 
 func (w *Watcher) GetEventChan() <-chan string {
 	return w.eventChan
 }
 
+// GetRemovedChan returns nil unless removals are reported.
+func (w *Watcher) GetRemovedChan() <-chan string {
+	return w.removedChan
+}
+
 func (w *Watcher) watchLoop() {
 	for {
 		select {
@@ -75,21 +171,25 @@ func (w *Watcher) watchLoop() {
 			if !ok {
 				return
 			}
+			if w.mode == ModeAuto {
+				w.markSeen(event.Name)
+			}
+			if !w.handleEvent(event) {
+				return
+			}
 
-			if event.Op&fsnotify.Create == fsnotify.Create || event.Op&fsnotify.Write == fsnotify.Write {
-				if w.isImageFile(event.Name) && w.shouldProcessFile(event.Name) {
-					time.Sleep(100 * time.Millisecond)
-
-					if w.isFileReady(event.Name) {
-						w.markFileProcessed(event.Name)
-						log.Printf("New image detected: %s", event.Name)
-						select {
-						case w.eventChan <- event.Name:
-						case <-w.doneChan:
-							return
-						}
-					}
-				}
+		case event := <-w.pollEvents:
+			if !w.handleEvent(event) {
+				return
+			}
+
+		case file := <-w.recheckChan:
+			w.mutex.Lock()
+			delete(w.rechecks, file)
+			w.mutex.Unlock()
+
+			if !w.emitFile(file) {
+				return
 			}
 
 		case err, ok := <-w.fsWatcher.Errors:
@@ -104,9 +204,309 @@ func (w *Watcher) watchLoop() {
 	}
 }
 
+// handleEvent processes a change reported by fsnotify or found by polling.
+// It returns false if the watcher was stopped.
+func (w *Watcher) handleEvent(event fsnotify.Event) bool {
+	if filepath.Base(event.Name) == ignoreFileName {
+		w.reloadIgnoreFile(event.Name)
+		return true
+	}
+
+	if event.Op&fsnotify.Create == fsnotify.Create && w.isDir(event.Name) {
+		return w.handleNewDir(event.Name)
+	}
+
+	if event.Op&fsnotify.Create == fsnotify.Create || event.Op&fsnotify.Write == fsnotify.Write {
+		if w.isImageFile(event.Name) && !w.emitFile(event.Name) {
+			return false
+		}
+	}
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && w.watchedDirs[event.Name] {
+		w.unwatchTree(event.Name)
+		return true
+	}
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && w.removedChan != nil && w.isImageFile(event.Name) {
+		w.forgetFile(event.Name)
+		log.Printf("Image removed: %s", event.Name)
+		select {
+		case w.removedChan <- event.Name:
+		case <-w.doneChan:
+			return false
+		}
+	}
+	return true
+}
+
+// emitFile reports a new or changed image once it is completely written.
+// It returns false if the watcher was stopped.
+func (w *Watcher) emitFile(filename string) bool {
+	if !w.shouldProcessFile(filename) {
+		return true
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if w.mode == ModeAuto {
+		// Files found while adding a new folder never get events of
+		// their own.
+		w.markSeen(filename)
+	}
+
+	if !w.isFileReady(filename) || !w.accept(filename) {
+		return true
+	}
+
+	w.markFileProcessed(filename)
+	log.Printf("New image detected: %s", filename)
+	select {
+	case w.eventChan <- filename:
+		return true
+	case <-w.doneChan:
+		return false
+	}
+}
+
+// accept applies the filter of the file's root and logs why a file is
+// skipped. Files that are too young are checked again once they are old
+// enough.
+func (w *Watcher) accept(filename string) bool {
+	root, ok := w.rootOf(filename)
+	if !ok {
+		return false
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+
+	reason, wait := root.filter.skipFile(w.relSlashPath(root, filename), info)
+	if reason == "" && w.isIgnored(root, filename, false) {
+		reason = "excluded by " + ignoreFileName
+	}
+	if reason == "" {
+		return true
+	}
+
+	log.Printf("Skipping %s: %s", filename, reason)
+	if wait > 0 {
+		w.scheduleRecheck(filename, wait)
+	}
+	return false
+}
+
+func (w *Watcher) scheduleRecheck(filename string, wait time.Duration) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.rechecks[filename] {
+		return
+	}
+	w.rechecks[filename] = true
+
+	time.AfterFunc(wait, func() {
+		select {
+		case w.recheckChan <- filename:
+		case <-w.doneChan:
+		}
+	})
+}
+
+// skipDir applies the filter of the folder's root. Skipped folders aren't
+// watched at all.
+func (w *Watcher) skipDir(root *Root, dir string) bool {
+	reason := w.dirSkipReason(root, dir)
+	if reason == "" {
+		return false
+	}
+
+	log.Printf("Skipping folder %s: %s", dir, reason)
+	return true
+}
+
+func (w *Watcher) dirSkipReason(root *Root, dir string) string {
+	if dir == root.Path {
+		return ""
+	}
+
+	reason := root.filter.skipDir(w.relSlashPath(root, dir))
+	if reason == "" && w.isIgnored(root, dir, true) {
+		reason = "excluded by " + ignoreFileName
+	}
+	return reason
+}
+
+func (w *Watcher) relSlashPath(root *Root, path string) string {
+	rel, err := filepath.Rel(root.Path, path)
+	if err != nil {
+		return filepath.ToSlash(filepath.Base(path))
+	}
+	return filepath.ToSlash(rel)
+}
+
+// handleNewDir watches a folder created or moved into the tree. Files that
+// landed in it before the watch was added are reported right away. It
+// returns false if the watcher was stopped.
+func (w *Watcher) handleNewDir(dir string) bool {
+	root, ok := w.rootOf(dir)
+	if !ok || !w.isWithinDepth(dir, true) || w.skipDir(root, dir) {
+		return true
+	}
+
+	if err := w.addWatch(dir); err != nil {
+		log.Printf("Failed to watch folder %s: %v", dir, err)
+		return true
+	}
+	w.watchedDirs[dir] = true
+	log.Printf("Watching new folder: %s", dir)
+
+	files, err := w.watchTree(dir)
+	if err != nil {
+		log.Printf("Failed to watch subfolders of %s: %v", dir, err)
+	}
+
+	for _, file := range files {
+		if !w.emitFile(file) {
+			return false
+		}
+	}
+	return true
+}
+
+// watchTree adds watches for all folders below dir within the depth limit
+// and returns the image files it came across.
+func (w *Watcher) watchTree(dir string) ([]string, error) {
+	var files []string
+
+	root, ok := w.rootOf(dir)
+	if !ok {
+		return nil, nil
+	}
+
+	err := w.walk(root, dir, func(path string, entry fs.DirEntry) error {
+		if !entry.IsDir() {
+			files = append(files, path)
+			return nil
+		}
+
+		if path == dir || w.watchedDirs[path] {
+			return nil
+		}
+
+		if err := w.addWatch(path); err != nil {
+			return fmt.Errorf("failed to watch folder %s: %w", path, err)
+		}
+		w.watchedDirs[path] = true
+		return nil
+	})
+
+	return files, err
+}
+
+// addWatch subscribes to the events of dir unless polling is all there is.
+func (w *Watcher) addWatch(dir string) error {
+	if w.mode == ModePoll {
+		return nil
+	}
+	return w.fsWatcher.Add(dir)
+}
+
+// unwatchTree drops the watches of a folder that was deleted or moved out
+// of the tree, together with those of its subfolders.
+func (w *Watcher) unwatchTree(dir string) {
+	prefix := dir + string(filepath.Separator)
+	for path := range w.watchedDirs {
+		if path != dir && !strings.HasPrefix(path, prefix) {
+			continue
+		}
+
+		// Watches of deleted folders are already gone.
+		_ = w.fsWatcher.Remove(path)
+		delete(w.watchedDirs, path)
+	}
+	log.Printf("Stopped watching folder: %s", dir)
+}
+
+// walk calls fn for every folder and image file below dir that belongs to
+// root and is within its depth limit, dir included. Nested roots are left
+// to their own walk.
+func (w *Watcher) walk(root *Root, dir string, fn func(path string, entry fs.DirEntry) error) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if owner, _ := w.rootOf(path); owner != root {
+				return filepath.SkipDir
+			}
+			if path != dir && (!w.isWithinDepth(path, true) || w.skipDir(root, path)) {
+				return filepath.SkipDir
+			}
+			return fn(path, entry)
+		}
+
+		if w.isImageFile(path) && w.isWithinDepth(path, false) {
+			return fn(path, entry)
+		}
+		return nil
+	})
+}
+
+// rootOf returns the innermost root containing path.
+func (w *Watcher) rootOf(path string) (*Root, bool) {
+	var found *Root
+	for _, root := range w.roots {
+		if path != root.Path && !strings.HasPrefix(path, root.Path+string(filepath.Separator)) {
+			continue
+		}
+		if found == nil || len(root.Path) > len(found.Path) {
+			found = root
+		}
+	}
+	return found, found != nil
+}
+
+// isWithinDepth checks path against the depth limit of its root. Folders
+// at the limit are left out, since files inside them would be too deep.
+func (w *Watcher) isWithinDepth(path string, isDir bool) bool {
+	root, ok := w.rootOf(path)
+	if !ok {
+		return false
+	}
+
+	if root.MaxDepth <= 0 {
+		return true
+	}
+
+	rel, err := filepath.Rel(root.Path, path)
+	if err != nil || rel == "." {
+		return true
+	}
+
+	depth := len(strings.Split(rel, string(filepath.Separator)))
+	if isDir {
+		return depth < root.MaxDepth
+	}
+	return depth <= root.MaxDepth
+}
+
+func (w *Watcher) isDir(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.IsDir()
+}
+
+// isImageFile checks filename against the formats of its root.
 func (w *Watcher) isImageFile(filename string) bool {
+	root, ok := w.rootOf(filename)
+	if !ok {
+		return false
+	}
+
 	ext := strings.ToLower(filepath.Ext(filename))
-	for _, supportedExt := range w.supportedFormats {
+	for _, supportedExt := range root.SupportedFormats {
 		if ext == supportedExt {
 			return true
 		}
@@ -130,8 +530,10 @@ func (w *Watcher) isFileReady(filename string) bool {
 	return stat1.Size() == stat2.Size() && stat1.ModTime().Equal(stat2.ModTime())
 }
 
+// DeleteFile deletes an uploaded file if its root asks for it.
 func (w *Watcher) DeleteFile(filename string) error {
-	if !w.deleteAfterUpload {
+	root, ok := w.rootOf(filename)
+	if !ok || !root.DeleteAfterUpload {
 		return nil
 	}
 
@@ -144,23 +546,44 @@ func (w *Watcher) DeleteFile(filename string) error {
 	return nil
 }
 
+// RelPath returns filename relative to its root.
+func (w *Watcher) RelPath(filename string) string {
+	root, ok := w.rootOf(filename)
+	if !ok {
+		return filepath.Base(filename)
+	}
+
+	rel, err := filepath.Rel(root.Path, filename)
+	if err != nil {
+		return filepath.Base(filename)
+	}
+	return rel
+}
+
+// RootPath returns the path of the root filename belongs to, or "" if it
+// is outside of all roots.
+func (w *Watcher) RootPath(filename string) string {
+	root, ok := w.rootOf(filename)
+	if !ok {
+		return ""
+	}
+	return root.Path
+}
+
 func (w *Watcher) ScanExistingFiles() ([]string, error) {
 	var files []string
 
-	err := filepath.Walk(w.watchPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	for _, root := range w.roots {
+		err := w.walk(root, root.Path, func(path string, entry fs.DirEntry) error {
+			if !entry.IsDir() && w.accept(path) {
+				files = append(files, path)
+			}
+			return nil
+		})
 
-		if !info.IsDir() && w.isImageFile(path) {
-			files = append(files, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan existing files in %s: %w", root.Path, err)
 		}
-
-		return nil
-	})
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to scan existing files: %w", err)
 	}
 
 	log.Printf("Found %d existing image files", len(files))
@@ -186,6 +609,15 @@ func (w *Watcher) markFileProcessed(filename string) {
 	w.processedFiles[filename] = time.Now()
 }
 
+// forgetFile lets a file that reappears under the same name be picked up
+// right away.
+func (w *Watcher) forgetFile(filename string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	delete(w.processedFiles, filename)
+}
+
 func (w *Watcher) cleanupLoop() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()